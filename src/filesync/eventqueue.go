@@ -1,6 +1,7 @@
 package filesync
 
 import (
+	"context"
 	"fmt"
 	"notify"
 	"time"
@@ -27,18 +28,42 @@ func startFrontend(evchan chan<- *Request, target string, includes []string, exc
 		fmt.Printf("%s %s %d\n", path, notify.MaskToString(event.Mask), event.Cookie)
 	}
 
-	doEvent := func(ev *notify.Event) {
-		fileSync := NewFileSync(target)
-		evchan <- NewRequest(fileSync, ev)
+	var callbacks = notify.NotifyCallbacks{
+		Init:   doInit,
+		Report: doReport,
 	}
 
-	var callbacks = notify.NotifyCallbacks{
-		doInit,
-		doReport,
-		doEvent,
+	watcher, err := notify.New(notify.Options{
+		Includes:  includes,
+		Excludes:  excludes,
+		Mask:      notify.IN_ALL,
+		Callbacks: &callbacks,
+	})
+	if err != nil {
+		fmt.Printf("Frontend: %s\n", err)
+		return
 	}
+	events := watcher.Events()
+	errors := watcher.Errors()
+	go watcher.Run(context.Background())
 
-	notify.ProcessNotifyEvents(includes, excludes, notify.IN_ALL, &callbacks)
+	fileSync := NewFileSync(target)
+	for events != nil || errors != nil {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				break
+			}
+			evchan <- NewRequest(fileSync, &ev)
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				break
+			}
+			fmt.Printf("Frontend: %s\n", err)
+		}
+	}
 }
 
 func startQueue(inchan <-chan *Request, outchan chan<- *Request, delay time.Duration) {
@@ -25,19 +25,31 @@ func (r Request)String() string {
 
 
 func NewRequest(fs *FileSync, ev *notify.Event) (res *Request) {
+	alt := altPath(ev)
 	res = &Request{
 		eventType:   ev.EventType,
 		source:      ev.Path,
-		sourceAlt:   ev.Path2,
+		sourceAlt:   alt,
 		dest: fs.SyncName(ev.Path),
-		destAlt: fs.SyncName(ev.Path2),	
+		destAlt: fs.SyncName(alt),	
 		key:         ev.Key,
 		fileSync:    fs,
-		eventTime:   time.Now(),
+		eventTime:   ev.Time,
 	}
 	return
 }
 
+// altPath is the previous path of a MOVE or an existing link of a LINK or DELETE
+func altPath(ev *notify.Event) string {
+	switch {
+	case ev.EventType == notify.MOVE:
+		return ev.OldPath
+	case (ev.EventType == notify.LINK || ev.EventType == notify.DELETE) && len(ev.OtherLinks) > 0:
+		return ev.OtherLinks[0]
+	}
+	return ""
+}
+
 // RewriteSource
 func RewriteSource(r *Request, newpath, oldpath string) {
 	rewrite(newpath, oldpath, &r.source)
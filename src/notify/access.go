@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"syscall"
+)
+
+// closeBits are the events of closing a file
+const closeBits uint32 = syscall.IN_CLOSE_WRITE | syscall.IN_CLOSE_NOWRITE
+
+/*
+ * Report the opening, reading and closing of the file of the event in wde,
+ * as far as given by bits, if access events are enabled.
+ * The reads are collected in the smask of the inode until the file is closed,
+ * and reported as one READ before the CLOSE.
+ */
+func (wt *WT) processAccess(event *EventIntern, wde *WatchDirent, bits uint32) {
+	mask := event.Mask & bits
+	if !wt.accessEvents || mask&(IN_READS|closeBits) == 0 || event.Mask&syscall.IN_ISDIR != 0 {
+		return
+	}
+	file := wde.child(event)
+	if file == nil {
+		return
+	}
+	if mask&syscall.IN_OPEN != 0 {
+		wt.callback(OPEN, event, file, false)
+	}
+	if mask&syscall.IN_ACCESS != 0 {
+		file.statid.smask |= syscall.IN_ACCESS
+	}
+	if mask&closeBits != 0 {
+		if file.statid.smask&syscall.IN_ACCESS != 0 {
+			file.statid.smask &^= syscall.IN_ACCESS
+			wt.callback(READ, event, file, false)
+		}
+		wt.callback(CLOSE, event, file, false)
+	}
+}
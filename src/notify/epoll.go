@@ -0,0 +1,140 @@
+package notify
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+fdWaiter reads from a non-blocking file descriptor like that of inotify or
+fanotify. It waits for data with epoll, together with an eventfd, which is
+signalled by close. So a waiting read returns promptly after close, without a
+goroutine or timer. The descriptors are closed by close, or by the waiting
+read, which is woken up. Only one read may wait at a time.
+*/
+type fdWaiter struct {
+	mu      sync.Mutex
+	fd      int  // non-blocking file descriptor to read from
+	epfd    int  // epoll instance watching fd and evfd
+	evfd    int  // eventfd signalled by close
+	closed  bool // close has been called
+	waiting bool // a read is in epoll_wait and closes the descriptors after close
+}
+
+// newFdWaiter takes over the non-blocking file descriptor fd, which is closed on failure.
+func newFdWaiter(fd int) (*fdWaiter, error) {
+	w := &fdWaiter{fd: fd, epfd: -1, evfd: -1}
+	fail := func(op string, err error) (*fdWaiter, error) {
+		w.closeFds()
+		return nil, os.NewSyscallError(op, err)
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return fail("epoll_create1", err)
+	}
+	w.epfd = epfd
+	r, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if errno != 0 {
+		return fail("eventfd2", errno)
+	}
+	w.evfd = int(r)
+	for _, fd := range []int{w.fd, w.evfd} {
+		ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+		if err = syscall.EpollCtl(w.epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+			return fail("epoll_ctl", err)
+		}
+	}
+	return w, nil
+}
+
+// use calls f with the file descriptor, unless it is closed.
+func (w *fdWaiter) use(f func(fd int) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	return f(w.fd)
+}
+
+/*
+ * Read into buf, waiting at most timeout for data, forever if timeout is negative.
+ * Return 0 without error, if the time expired, and ErrClosed after close.
+ */
+func (w *fdWaiter) read(buf []byte, timeout time.Duration) (n int, err error) {
+	deadline := time.Now().Add(timeout)
+	var events [2]syscall.EpollEvent
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return 0, ErrClosed
+		}
+		n, err = syscall.Read(w.fd, buf)
+		if err != syscall.EAGAIN && err != syscall.EINTR {
+			w.mu.Unlock()
+			if err != nil {
+				n = 0
+			}
+			return
+		}
+		msec := -1
+		if timeout >= 0 {
+			rest := time.Until(deadline)
+			if rest <= 0 {
+				w.mu.Unlock()
+				return 0, nil
+			}
+			msec = int((rest + time.Millisecond - 1) / time.Millisecond)
+		}
+		w.waiting = true
+		w.mu.Unlock()
+
+		_, err = syscall.EpollWait(w.epfd, events[:], msec)
+
+		w.mu.Lock()
+		w.waiting = false
+		if w.closed {
+			w.closeFds()
+			w.mu.Unlock()
+			return 0, ErrClosed
+		}
+		w.mu.Unlock()
+		if err != nil && err != syscall.EINTR {
+			return 0, os.NewSyscallError("epoll_wait", err)
+		}
+	}
+}
+
+// close wakes up a waiting read, which closes the descriptors, or closes them.
+func (w *fdWaiter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.waiting {
+		var one [8]byte
+		binary.NativeEndian.PutUint64(one[:], 1)
+		_, err := syscall.Write(w.evfd, one[:])
+		return err
+	}
+	return w.closeFds()
+}
+
+// closeFds closes all descriptors.
+func (w *fdWaiter) closeFds() (err error) {
+	for _, fd := range []*int{&w.fd, &w.epfd, &w.evfd} {
+		if *fd >= 0 {
+			if err1 := syscall.Close(*fd); err == nil {
+				err = err1
+			}
+			*fd = -1
+		}
+	}
+	return
+}
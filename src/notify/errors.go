@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Errors reported by a Watcher. Use errors.Is to test for them,
+// as they are usually wrapped in a *PathError.
+var (
+	ErrNoWatches      = errors.New("notify: no directories or files to watch")
+	ErrQueueOverflow  = errors.New("notify: inotify event queue overflow")
+	ErrZeroWatch      = errors.New("notify: event with zero watch descriptor")
+	ErrMissingElement = errors.New("notify: missing directory element")
+	ErrWatchLimit     = errors.New("notify: inotify watch limit reached")
+
+	ErrOverlappingRoot = errors.New("notify: root overlaps a watched root")
+	ErrUnknownRoot     = errors.New("notify: not a watched root")
+	ErrExcluded        = errors.New("notify: path is excluded")
+	ErrClosed          = errors.New("notify: watcher closed")
+	ErrNoSnapshot      = errors.New("notify: no snapshot file configured")
+)
+
+/*
+PathError records an error and the operation and file path that caused it.
+*/
+type PathError struct {
+	Op   string // failing operation, e.g. "lstat" or "inotify_add_watch"
+	Path string // path name of the file or directory
+	Err  error  // underlying error
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("%s(%q): %s", e.Op, e.Path, e.Err)
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+/*
+WatchLimitWarning is reported, if directories could not be watched,
+because the inotify watches or instances are exhausted. Changes in those
+directories are lost, unless they are polled. Raise the limit by
+sysctl fs.inotify.max_user_watches to at least Needed plus the watches
+of other programs.
+*/
+type WatchLimitWarning struct {
+	Path      string // first directory, which could not be watched
+	Limit     int    // value of /proc/sys/fs/inotify/max_user_watches, -1 if unknown
+	Needed    int    // number of directories in the watched trees
+	Unwatched int    // number of directories, which could not be watched
+	Polled    bool   // the unwatched directories are polled
+	Err       error  // error of the first failing inotify_add_watch
+}
+
+func (w *WatchLimitWarning) Error() string {
+	s := fmt.Sprintf("notify: %d of %d directories not watched, max_user_watches is %d, first %q",
+		w.Unwatched, w.Needed, w.Limit, w.Path)
+	if w.Polled {
+		s += ", polling instead"
+	}
+	return s
+}
+
+func (w *WatchLimitWarning) Unwrap() error {
+	return w.Err
+}
+
+// maxUserWatches reads the limit of inotify watches, -1 if unknown.
+func maxUserWatches() int {
+	data, err := os.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		return -1
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// watchError wraps an error of inotify_add_watch. Running out of
+// watches or inotify instances is also reported as ErrWatchLimit.
+func watchError(path string, err error) error {
+	if err == syscall.ENOSPC || err == syscall.EMFILE {
+		err = fmt.Errorf("%w: %w", ErrWatchLimit, err)
+	}
+	return &PathError{Op: "inotify_add_watch", Path: path, Err: err}
+}
+
+// resultCode maps errors to the result codes of ProcessNotifyEvents.
+func resultCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrNoWatches):
+		return 1
+	case errors.Is(err, ErrQueueOverflow):
+		return 2
+	case errors.Is(err, ErrZeroWatch):
+		return 3
+	}
+	return 99
+}
@@ -0,0 +1,83 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// MarshalText implements encoding.TextMarshaler.
+func (et EventType) MarshalText() ([]byte, error) {
+	return []byte(et.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (et *EventType) UnmarshalText(text []byte) error {
+	for t := CREATE; t <= CLOSE; t++ {
+		if t.String() == string(text) {
+			*et = t
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event type %q", text)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (kind FileKind) MarshalText() ([]byte, error) {
+	return []byte(kind.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (kind *FileKind) UnmarshalText(text []byte) error {
+	for k := KindOther; k <= KindSymlink; k++ {
+		if k.String() == string(text) {
+			*kind = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown file kind %q", text)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (changed AttrChange) MarshalText() ([]byte, error) {
+	return []byte(changed.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (changed *AttrChange) UnmarshalText(text []byte) error {
+	*changed = 0
+	if len(text) == 0 {
+		return nil
+	}
+	for _, name := range strings.Split(string(text), ",") {
+		var attr AttrChange
+		for bit := AttrMode; bit <= AttrMtime; bit <<= 1 {
+			if bit.String() == name {
+				attr = bit
+			}
+		}
+		if attr == 0 {
+			return fmt.Errorf("unknown attribute %q", name)
+		}
+		*changed |= attr
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+// StatKey is no encoding.TextMarshaler, which would change its gob encoding in snapshot files.
+func (key StatKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(key.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (key *StatKey) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if _, err := fmt.Sscanf(s, "%x.%d", &key.Dev, &key.Ino); err != nil {
+		return fmt.Errorf("invalid key %q: %w", s, err)
+	}
+	return nil
+}
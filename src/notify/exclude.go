@@ -0,0 +1,178 @@
+package notify
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+/*
+ignoreRule is a single exclude pattern in the syntax of .gitignore files.
+Patterns are split into path segments; each segment is matched by
+filepath.Match, the segment "**" matches any number of segments.
+*/
+type ignoreRule struct {
+	segments []string // pattern split at "/"
+	negate   bool     // pattern started with "!" - matching entries are included again
+	dirOnly  bool     // pattern ended with "/" - matches directories only
+}
+
+// parseRule converts one line of an ignore file or one exclude pattern.
+// Empty lines and comments return ok == false.
+// Patterns without an inner slash match at any depth below the base directory.
+func parseRule(line string) (rule ignoreRule, ok bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimLeft(line, "/")
+	rule.segments = strings.Split(line, "/")
+	if !anchored {
+		rule.segments = append([]string{"**"}, rule.segments...)
+	}
+	return rule, true
+}
+
+// match reports if the rule matches the slash separated path rel.
+func (rule *ignoreRule) match(rel string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(rule.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches path segments against pattern segments.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, err := filepath.Match(pattern[0], segments[0]); err != nil || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+// matchRules applies a list of rules to rel. The last matching rule decides.
+// matched is false if no rule matched at all.
+func matchRules(rules []ignoreRule, rel string, isDir bool) (matched, excluded bool) {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].match(rel, isDir) {
+			return true, !rules[i].negate
+		}
+	}
+	return
+}
+
+// isPattern reports if an exclude argument is a pattern rather than a path name.
+func isPattern(exclude string) bool {
+	return strings.HasPrefix(exclude, "!") || strings.ContainsAny(exclude, "*?[")
+}
+
+/*
+ * Add exclude pattern to the list of global patterns.
+ * Patterns starting with "/" are matched against the complete path name,
+ * all others against the trailing part of the path name.
+ */
+func (wt *WT) addExcludePattern(pattern string) {
+	if rule, ok := parseRule(pattern); ok {
+		if !strings.HasPrefix(pattern, "/") && !strings.HasPrefix(pattern, "!/") &&
+			rule.segments[0] != "**" {
+			rule.segments = append([]string{"**"}, rule.segments...)
+		}
+		wt.globs = append(wt.globs, rule)
+	}
+}
+
+/*
+ * Read the rules of the ignore file in directory wde.
+ * A missing ignore file removes the rules of the directory.
+ */
+func (wt *WT) loadIgnoreFile(wde *WatchDirent) {
+	if wt.ignoreFile == "" {
+		return
+	}
+	path := wde.Path(wt.ignoreFile)
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			wt.reportError(&PathError{Op: "open", Path: path, Err: err})
+		}
+		delete(wt.ignores, wde)
+		return
+	}
+	defer file.Close()
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		wt.reportError(&PathError{Op: "read", Path: path, Err: err})
+	}
+	if len(rules) > 0 {
+		wt.ignores[wde] = rules
+	} else {
+		delete(wt.ignores, wde)
+	}
+}
+
+/*
+ * Check if entry name in directory wde shall not be watched.
+ * Excluded path names are checked first, then the ignore files from the
+ * directory upwards, where the deepest matching file decides,
+ * finally the global exclude patterns.
+ */
+func (wt *WT) excluded(wde *WatchDirent, name string, isDir bool) bool {
+	if len(wt.fileRoots) > 0 {
+		if names, ok := wt.fileRoots[wde]; ok && !slices.Contains(names, name) {
+			return true // not a file root of a directory watched for its file roots
+		}
+	}
+	path := wde.Path(name)
+	if wt.excludes[path] {
+		return true
+	}
+	rel := name
+	for dir := wde; dir != nil && dir.parent != nil; dir = dir.parent {
+		if rules, ok := wt.ignores[dir]; ok {
+			if matched, excluded := matchRules(rules, rel, isDir); matched {
+				return excluded
+			}
+		}
+		rel = dir.name + "/" + rel
+	}
+	if len(wt.globs) > 0 {
+		_, excluded := matchRules(wt.globs, strings.TrimLeft(filepath.ToSlash(path), "/"), isDir)
+		return excluded
+	}
+	return false
+}
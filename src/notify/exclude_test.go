@@ -0,0 +1,44 @@
+package notify
+
+import (
+	"testing"
+)
+
+func TestMatchRules(t *testing.T) {
+	tests := []struct {
+		rules    []string
+		rel      string
+		isDir    bool
+		excluded bool
+	}{
+		{[]string{"*.o"}, "main.o", false, true},
+		{[]string{"*.o"}, "src/lib/main.o", false, true},
+		{[]string{"*.o"}, "main.c", false, false},
+		{[]string{"**/node_modules"}, "node_modules", true, true},
+		{[]string{"**/node_modules"}, "web/app/node_modules", true, true},
+		{[]string{"build/"}, "build", false, false},
+		{[]string{"build/"}, "sub/build", true, true},
+		{[]string{"/build"}, "sub/build", true, false},
+		{[]string{"/build"}, "build", true, true},
+		{[]string{"doc/*.html"}, "doc/index.html", false, true},
+		{[]string{"doc/*.html"}, "x/doc/index.html", false, false},
+		{[]string{"a/**/b"}, "a/b", false, true},
+		{[]string{"a/**/b"}, "a/x/y/b", false, true},
+		{[]string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{[]string{"*.log", "!keep.log"}, "drop.log", false, true},
+		{[]string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{[]string{"# comment", "", `\#name`}, "#name", false, true},
+	}
+	for _, test := range tests {
+		var rules []ignoreRule
+		for _, line := range test.rules {
+			if rule, ok := parseRule(line); ok {
+				rules = append(rules, rule)
+			}
+		}
+		_, excluded := matchRules(rules, test.rel, test.isDir)
+		if excluded != test.excluded {
+			t.Error("matchRules", test.rules, test.rel, "expected", test.excluded, "!=", excluded)
+		}
+	}
+}
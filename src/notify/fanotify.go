@@ -0,0 +1,329 @@
+package notify
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// fanotify constants, see fanotify_init(2), fanotify_mark(2) and fanotify(7).
+// The event bits are the same as those of inotify.
+const (
+	fanCloexec         = 0x00000001
+	fanNonblock        = 0x00000002
+	fanReportDfidName  = 0x00000c00 // FAN_REPORT_DIR_FID | FAN_REPORT_NAME
+	fanMarkAdd         = 0x00000001
+	fanMarkFilesystem  = 0x00000100
+	fanOnDir           = 0x40000000
+	fanInfoDfidName    = 2
+	fanInfoDfid        = 3
+	fanMetadataVersion = 3
+	fanMetadataSize    = 24
+	fanMinBuffer       = 4096 // holds several events with maximal handles and names
+	maxHandleSize      = 128
+)
+
+// event bits supported by fanotify
+const fanEvents uint32 = syscall.IN_ACCESS | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_CLOSE_WRITE | syscall.IN_CLOSE_NOWRITE | syscall.IN_OPEN |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+/*
+FanotifySource is an EventSource based on fanotify. It marks the complete
+file system of each watched directory, so it needs no kernel resources per
+directory and is not limited by max_user_watches. Events of directories,
+which are not watched, are read and dropped. The events carry the PID of the
+process causing them.
+
+fanotify requires CAP_SYS_ADMIN and Linux 5.9. Mount marks cannot report
+creation, deletion and renaming, so only file system marks are used.
+fanotify does not pair renames by cookies. The source assigns a cookie to a
+moved-from event and passes it to an immediately following moved-to event.
+Events of the same name may be merged into one event with several bits.
+*/
+type FanotifySource struct {
+	mask       uint64
+	waiter     *fdWaiter // non-blocking fanotify file descriptor
+	readbuffer []byte
+	pos        int
+	max        int
+	peeked     *EventIntern // next event, decoded by buffered
+	readTime   time.Time    // time of the last read
+	mu         sync.Mutex
+	wds        map[string]uint32 // watch descriptor by file system id and file handle
+	handles    map[uint32]string // file handle by watch descriptor
+	marks      map[[2]int32]bool // marked file systems
+	lastWd     uint32            // last assigned watch descriptor
+	cookie     uint32            // last assigned cookie
+	fromCookie uint32            // cookie of the last event, if it was a moved-from
+}
+
+// NewFanotifySource creates a FanotifySource for the events in mask.
+func NewFanotifySource(mask uint32) (fs *FanotifySource, err error) {
+	return NewFanotifySourceSize(mask, DefaultReadBuffer)
+}
+
+// NewFanotifySourceSize creates a FanotifySource, which reads up to size bytes of events at once.
+func NewFanotifySourceSize(mask uint32, size int) (fs *FanotifySource, err error) {
+	if size < fanMinBuffer {
+		size = fanMinBuffer
+	}
+	fd, _, errno := syscall.Syscall(syscall.SYS_FANOTIFY_INIT, fanCloexec|fanNonblock|fanReportDfidName,
+		uintptr(syscall.O_RDONLY|syscall.O_LARGEFILE), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("fanotify_init", errno)
+	}
+	waiter, err := newFdWaiter(int(fd))
+	if err != nil {
+		return nil, err
+	}
+	fs = &FanotifySource{
+		mask:       uint64(mask&fanEvents) | fanOnDir,
+		waiter:     waiter,
+		readbuffer: make([]byte, size),
+		wds:        make(map[string]uint32),
+		handles:    make(map[uint32]string),
+		marks:      make(map[[2]int32]bool),
+	}
+	return
+}
+
+// AddWatch marks the file system of directory path, if not yet done,
+// and assigns a watch descriptor to the file handle of path.
+func (fs *FanotifySource) AddWatch(path string) (wd uint32, err error) {
+	var statfs syscall.Statfs_t
+	if err = syscall.Statfs(path, &statfs); err != nil {
+		return 0, &PathError{Op: "statfs", Path: path, Err: err}
+	}
+	handle, err := fileHandle(path, statfs.Fsid.X__val)
+	if err != nil {
+		return 0, &PathError{Op: "name_to_handle_at", Path: path, Err: err}
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	err = fs.waiter.use(func(fd int) error {
+		if fs.marks[statfs.Fsid.X__val] {
+			return nil
+		}
+		if err := fs.mark(fd, path); err != nil {
+			return &PathError{Op: "fanotify_mark", Path: path, Err: err}
+		}
+		fs.marks[statfs.Fsid.X__val] = true
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	wd, ok := fs.wds[handle]
+	if !ok {
+		fs.lastWd++
+		wd = fs.lastWd
+		fs.wds[handle] = wd
+		fs.handles[wd] = handle
+	}
+	return
+}
+
+// mark adds a mark for the file system containing path to the fanotify descriptor fd.
+func (fs *FanotifySource) mark(fd int, path string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FANOTIFY_MARK, uintptr(fd), fanMarkAdd|fanMarkFilesystem,
+		uintptr(fs.mask), uintptr(_AT_FDCWD), uintptr(unsafe.Pointer(p)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// _AT_FDCWD as unsigned value
+const _AT_FDCWD = ^uintptr(99)
+
+// fileHandle returns the file system id and the file handle of path as a string,
+// in the layout of a fanotify file id record.
+func fileHandle(path string, fsid [2]int32) (string, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 8+8+maxHandleSize)
+	binary.NativeEndian.PutUint32(buf[0:], uint32(fsid[0]))
+	binary.NativeEndian.PutUint32(buf[4:], uint32(fsid[1]))
+	binary.NativeEndian.PutUint32(buf[8:], maxHandleSize)
+	var mountID int32
+	_, _, errno := syscall.Syscall6(sysNameToHandleAt, _AT_FDCWD, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&buf[8])), uintptr(unsafe.Pointer(&mountID)), 0, 0)
+	if errno != 0 {
+		return "", errno
+	}
+	size := binary.NativeEndian.Uint32(buf[8:])
+	return string(buf[:16+size]), nil
+}
+
+// RemoveWatch forgets the file handle of wd. The file system mark is kept.
+func (fs *FanotifySource) RemoveWatch(wd uint32) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if handle, ok := fs.handles[wd]; ok {
+		delete(fs.wds, handle)
+		delete(fs.handles, wd)
+	}
+	return nil
+}
+
+/*
+NextEvent reads the next event of a watched directory.
+Events of other directories are dropped.
+*/
+func (fs *FanotifySource) NextEvent() (ev *EventIntern, err error) {
+	return fs.next(-1)
+}
+
+// next returns the next event of a watched directory, waiting at most timeout, forever if negative.
+func (fs *FanotifySource) next(timeout time.Duration) (ev *EventIntern, err error) {
+	deadline := time.Now().Add(timeout)
+	for first := true; ; first = false {
+		if ev = fs.decode(); ev != nil {
+			return
+		}
+		if !first && timeout >= 0 {
+			// the last read delivered events of other directories only
+			if timeout = time.Until(deadline); timeout <= 0 {
+				return nil, nil
+			}
+		}
+		n, err := fs.waiter.read(fs.readbuffer, timeout)
+		if err != nil {
+			if err != ErrClosed {
+				err = &PathError{Op: "read", Path: "fanotify", Err: err}
+			}
+			return nil, err
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		fs.pos, fs.max = 0, n
+		fs.readTime = time.Now()
+	}
+}
+
+// decode returns the next event of a watched directory in the read buffer, nil if there is none.
+func (fs *FanotifySource) decode() *EventIntern {
+	if ev := fs.peeked; ev != nil {
+		fs.peeked = nil
+		return ev
+	}
+	for fs.pos+fanMetadataSize <= fs.max {
+		buf := fs.readbuffer[fs.pos:fs.max]
+		size := int(binary.NativeEndian.Uint32(buf))
+		if size < fanMetadataSize || size > len(buf) {
+			fs.pos = fs.max
+			break
+		}
+		fs.pos += size
+		if ev := fs.parse(buf[:size]); ev != nil {
+			return ev
+		}
+	}
+	return nil
+}
+
+/*
+NextBatch returns the events of watched directories of the next read, at least one.
+Events left in the read buffer by NextEvent are returned without reading.
+*/
+func (fs *FanotifySource) NextBatch() (evs []*EventIntern, err error) {
+	ev, err := fs.NextEvent()
+	for ; ev != nil; ev = fs.decode() {
+		evs = append(evs, ev)
+	}
+	return
+}
+
+// buffered is true, if the rest of a read contains an event of a watched directory.
+func (fs *FanotifySource) buffered() bool {
+	if fs.peeked == nil {
+		fs.peeked = fs.decode()
+	}
+	return fs.peeked != nil
+}
+
+// parse converts one fanotify event into an EventIntern, nil if the directory is not watched.
+func (fs *FanotifySource) parse(buf []byte) *EventIntern {
+	if buf[4] != fanMetadataVersion {
+		return nil
+	}
+	metalen := int(binary.NativeEndian.Uint16(buf[6:]))
+	mask := uint32(binary.NativeEndian.Uint64(buf[8:]))
+	if fd := int32(binary.NativeEndian.Uint32(buf[16:])); fd >= 0 {
+		syscall.Close(int(fd))
+	}
+	ev := &EventIntern{Mask: mask, Pid: int32(binary.NativeEndian.Uint32(buf[20:])), Time: fs.readTime}
+
+	fromCookie := fs.fromCookie
+	fs.fromCookie = 0
+	switch {
+	case mask&syscall.IN_MOVED_FROM != 0:
+		fs.cookie++
+		ev.Cookie = fs.cookie
+		fs.fromCookie = fs.cookie
+	case mask&syscall.IN_MOVED_TO != 0:
+		ev.Cookie = fromCookie
+	}
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		ev.Wd = ^uint32(0)
+		return ev
+	}
+
+	// the first directory file id record
+	for pos := metalen; pos+4 <= len(buf); {
+		infoType := buf[pos]
+		infoLen := int(binary.NativeEndian.Uint16(buf[pos+2:]))
+		if infoLen < 4 || pos+infoLen > len(buf) {
+			break
+		}
+		info := buf[pos : pos+infoLen]
+		pos += infoLen
+		if infoType != fanInfoDfidName && infoType != fanInfoDfid || len(info) < 20 {
+			continue
+		}
+		size := int(binary.NativeEndian.Uint32(info[12:]))
+		if 20+size > len(info) {
+			break
+		}
+		fs.mu.Lock()
+		wd, ok := fs.wds[string(info[4:20+size])]
+		fs.mu.Unlock()
+		if !ok {
+			return nil
+		}
+		ev.Wd = wd
+		if infoType == fanInfoDfidName {
+			ev.Name = byteToString(info[20+size:], uint32(len(info)-20-size))
+		}
+		if ev.Name == "." {
+			ev.Name = ""
+		}
+		return ev
+	}
+	return nil
+}
+
+// Next implements EventSource
+func (fs *FanotifySource) Next(timeout time.Duration) (*EventIntern, error) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	return fs.next(timeout)
+}
+
+// Close the fanotify file descriptor. Waiting calls of Next return immediately.
+func (fs *FanotifySource) Close() error {
+	return fs.waiter.close()
+}
@@ -0,0 +1,4 @@
+package notify
+
+// syscall number of name_to_handle_at, which is missing in package syscall
+const sysNameToHandleAt = 341
@@ -0,0 +1,7 @@
+//go:build !amd64 && !386
+
+package notify
+
+import "syscall"
+
+const sysNameToHandleAt = syscall.SYS_NAME_TO_HANDLE_AT
@@ -0,0 +1,113 @@
+package notify
+
+import (
+	"iter"
+	"path/filepath"
+	"slices"
+	"syscall"
+)
+
+/*
+ * Add the file ppath as root. Its directory is watched, but not scanned, and only
+ * the names of its file roots are admitted to its elements. So the name stays watched,
+ * when the file is replaced by rename-over-save or deleted and created again.
+ */
+func (wt *WT) insertFileRoot(ppath string) (wde *WatchDirent, err error) {
+	dir, name := filepath.Dir(ppath), filepath.Base(ppath)
+	if wt.excluded(&wt.root, ppath, false) {
+		return nil, &PathError{Op: "include", Path: ppath, Err: ErrExcluded}
+	}
+	parent := wt.root.elements.get(dir)
+	if _, ok := wt.fileRoots[parent]; !ok {
+		var stat syscall.Stat_t
+		if err = syscall.Lstat(dir, &stat); err != nil {
+			return nil, &PathError{Op: "lstat", Path: dir, Err: err}
+		}
+		parent = wt.newEntry(&wt.root, dir, &Statid{filestat: newFileStat(&stat)})
+		if parent == nil {
+			return nil, &PathError{Op: "include", Path: ppath, Err: ErrExcluded}
+		}
+		wt.selectBackend(parent)
+		if err = wt.addWatch(parent); err != nil {
+			wt.removeHierarchy(parent)
+			return nil, err
+		}
+	}
+	wt.fileRoots[parent] = append(wt.fileRoots[parent], name)
+	wde = wt.statNewFile(parent, name)
+	wt.reportWatchLimit()
+	return
+}
+
+/*
+ * Remove the file root ppath, and the watch of its directory, if it was the last one there.
+ * Return false, if ppath is not a file root.
+ */
+func (wt *WT) removeFileRoot(ppath string) bool {
+	dir, name := filepath.Dir(ppath), filepath.Base(ppath)
+	parent := wt.root.elements.get(dir)
+	names := wt.fileRoots[parent]
+	if !slices.Contains(names, name) {
+		return false
+	}
+	names = slices.DeleteFunc(names, func(n string) bool { return n == name })
+	if len(names) == 0 {
+		wt.removeHierarchy(parent)
+		return true
+	}
+	wt.fileRoots[parent] = names
+	if wde := parent.elements.get(name); wde != nil {
+		wt.removeHierarchy(wde)
+	}
+	return true
+}
+
+/*
+ * Process an event of a directory watched for its file roots.
+ * If it is deleted or moved away, its file roots are deleted.
+ */
+func (wt *WT) processFileDir(event *EventIntern, wde *WatchDirent) error {
+	mask := event.Mask
+	switch {
+	case mask&syscall.IN_IGNORED != 0:
+		delete(wt.data, event.Wd)
+	case mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0:
+		names := wt.fileRoots[wde]
+		var files []*WatchDirent
+		for _, file := range wde.elements.all() {
+			files = append(files, file)
+		}
+		wt.removeHierarchy(wde)
+		for _, file := range files {
+			wt.callbackDelete(event, file)
+		}
+		if wt.persistRoots {
+			for _, name := range names {
+				wt.armRoot(wde.Path(name))
+			}
+		}
+	}
+	return nil
+}
+
+// rootPaths yields the paths of the roots, the file roots instead of their directories, and the missing roots.
+func (wt *WT) rootPaths() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for name, wde := range wt.root.elements.all() {
+			if names, ok := wt.fileRoots[wde]; ok {
+				for _, file := range names {
+					if !yield(wde.Path(file)) {
+						return
+					}
+				}
+			} else if !yield(name) {
+				return
+			}
+		}
+		for name := range wt.pendingRoots {
+			if !yield(name) {
+				return
+			}
+		}
+	}
+}
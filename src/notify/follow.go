@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// oPath is O_PATH of open(2), which is missing in package syscall.
+const oPath = 0x200000
+
+// openRoot keeps a file descriptor of the root wde, which finds its path after a rename.
+func (wt *WT) openRoot(wde *WatchDirent) {
+	fd, err := syscall.Open(wde.name, oPath|syscall.O_CLOEXEC|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		wt.reportError(&PathError{Op: "open", Path: wde.name, Err: err})
+		return
+	}
+	wt.rootFds[wde] = fd
+}
+
+// closeRoot closes the file descriptor of root wde, if it has one.
+func (wt *WT) closeRoot(wde *WatchDirent) {
+	if fd, ok := wt.rootFds[wde]; ok {
+		syscall.Close(fd)
+		delete(wt.rootFds, wde)
+	}
+}
+
+/*
+ * Find the new path of the renamed root wde by its file descriptor and report the MOVE.
+ * Return false, if the root cannot be followed, because it was moved to a path,
+ * which is excluded or overlaps another root, or if its file descriptor is lost.
+ */
+func (wt *WT) followRoot(event *EventIntern, wde *WatchDirent) bool {
+	fd, ok := wt.rootFds[wde]
+	if !ok {
+		return false
+	}
+	newpath, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+	if err != nil || !filepath.IsAbs(newpath) || strings.HasSuffix(newpath, " (deleted)") {
+		return false
+	}
+	oldpath := wde.name
+	if newpath == oldpath {
+		return true // moved back or followed already
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(newpath, &stat); err != nil || (StatKey{stat.Dev, stat.Ino}) != wde.statid.key() {
+		return false
+	}
+	for name := range wt.rootPaths() {
+		if name != oldpath && overlapping(name, newpath) {
+			return false
+		}
+	}
+	if wt.excluded(&wt.root, newpath, wde.elements != nil) {
+		return false
+	}
+	wt.root.elements.remove(oldpath)
+	wde.name = newpath
+	wt.root.elements.set(wde)
+	wt.callback(MOVE, event, wde, false, oldpath)
+	return true
+}
+
+// overlapping is true, if one of the paths contains the other.
+func overlapping(path1, path2 string) bool {
+	return path1 == path2 || strings.HasPrefix(path1, path2+"/") || strings.HasPrefix(path2, path1+"/")
+}
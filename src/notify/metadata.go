@@ -0,0 +1,115 @@
+package notify
+
+import (
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FileKind is the type of file of an event.
+type FileKind uint8
+
+const (
+	KindOther   = FileKind(0) // device, pipe or socket
+	KindRegular = FileKind(1)
+	KindDir     = FileKind(2)
+	KindSymlink = FileKind(3)
+)
+
+func (kind FileKind) String() (out string) {
+	switch kind {
+	case KindRegular:
+		out = "regular"
+	case KindDir:
+		out = "dir"
+	case KindSymlink:
+		out = "symlink"
+	default:
+		out = "other"
+	}
+	return
+}
+
+// fileKind derives the FileKind from the file type bits of mode.
+func fileKind(mode uint32) FileKind {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		return KindRegular
+	case syscall.S_IFDIR:
+		return KindDir
+	case syscall.S_IFLNK:
+		return KindSymlink
+	}
+	return KindOther
+}
+
+// AttrChange is the set of attributes, which were changed according to an ATTRIBUTE event.
+type AttrChange uint8
+
+const (
+	AttrMode  AttrChange = 1 << iota // permission bits
+	AttrUid                          // owner
+	AttrGid                          // group
+	AttrSize                         // size, e.g. by truncate
+	AttrMtime                        // modification time, e.g. by touch
+)
+
+func (changed AttrChange) String() string {
+	names := []string{"mode", "uid", "gid", "size", "mtime"}
+	var out []string
+	for i, name := range names {
+		if changed&(1<<i) != 0 {
+			out = append(out, name)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// attrChanges compares two stat results of the same inode.
+func attrChanges(old, new *fileStat) (changed AttrChange) {
+	if old.Mode != new.Mode {
+		changed |= AttrMode
+	}
+	if old.Uid != new.Uid {
+		changed |= AttrUid
+	}
+	if old.Gid != new.Gid {
+		changed |= AttrGid
+	}
+	if old.Size != new.Size {
+		changed |= AttrSize
+	}
+	if old.Mtim != new.Mtim {
+		changed |= AttrMtime
+	}
+	return
+}
+
+// setStat copies the metadata of the file status into the event.
+func (ev *Event) setStat(stat *fileStat) {
+	ev.Kind = fileKind(stat.Mode)
+	ev.Size = stat.Size
+	ev.Mode = stat.Mode
+	ev.Uid = stat.Uid
+	ev.Gid = stat.Gid
+	ev.Mtime = time.Unix(0, stat.Mtim)
+	ev.Ctime = time.Unix(0, stat.Ctim)
+}
+
+/*
+ * Read the file status of wde again, so the following event describes the file as it is now.
+ * Return the changed attributes. The status is kept, if wde was replaced by another inode.
+ */
+func (wt *WT) restat(wde *WatchDirent) (changed AttrChange) {
+	var stat syscall.Stat_t
+	if syscall.Lstat(wde.Path(), &stat) != nil {
+		return
+	}
+	filestat := newFileStat(&stat)
+	if filestat.Dev != wde.statid.filestat.Dev || filestat.Ino != wde.statid.filestat.Ino {
+		return
+	}
+	changed = attrChanges(&wde.statid.filestat, &filestat)
+	wde.statid.filestat = filestat
+	return
+}
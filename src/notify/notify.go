@@ -1,35 +1,65 @@
 package notify
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 )
 
+/*
+Event describes a change in the watched trees.
+In its JSON form, the event type, the kind of file and the changed attributes
+are given by their strings, like "CHANGE", "regular" and "mode,uid", and a StatKey
+by its string "dev.ino" with dev in hex. Empty fields are omitted.
+*/
 type Event struct {
-	EventType    EventType
-	IsDir        bool
-	DataModified bool
-	Path         string
-	Path2        string
-	Key          StatKey
+	EventType    EventType `json:"type"`
+	IsDir        bool      `json:"isDir,omitempty"`
+	DataModified bool      `json:"dataModified,omitempty"`
+	Path         string    `json:"path,omitempty"`
+	OldPath      string    `json:"oldPath,omitempty"`    // previous path of a MOVE
+	OtherLinks   []string  `json:"otherLinks,omitempty"` // other known paths of the inode, the existing links of a LINK or DELETE
+	Key          StatKey   `json:"key,omitzero"`
+	OldKey       StatKey   `json:"oldKey,omitzero"` // replaced inode of a CHANGE by an atomic save
+	Pid          int32     `json:"pid,omitempty"`   // process causing the event, 0 if unknown
+	Seq          uint64    `json:"seq,omitempty"`   // number of the event, counting from 1 for each Watcher
+	Time         time.Time `json:"time,omitzero"`   // time the event was read or found by a scan, ordered like Seq
+
+	// metadata of the file as last read by lstat
+	Kind    FileKind   `json:"kind,omitzero"`
+	Size    int64      `json:"size,omitzero"`
+	Mode    uint32     `json:"mode,omitzero"` // st_mode including the file type bits
+	Uid     uint32     `json:"uid,omitempty"`
+	Gid     uint32     `json:"gid,omitempty"`
+	Mtime   time.Time  `json:"mtime,omitzero"`
+	Ctime   time.Time  `json:"ctime,omitzero"`
+	Changed AttrChange `json:"changed,omitzero"` // attributes changed according to an ATTRIBUTE event
 }
 
 /*
 NotifyCallbacks is a list of callback function provided by the user
 */
 type NotifyCallbacks struct {
-	Init   InitCallback
-	Report ReportCallback
-	Event  EventCallback
+	Init     InitCallback
+	Report   ReportCallback
+	Event    EventCallback
+	Error    ErrorCallback
+	Progress ProgressCallback
+	Batch    BatchCallback
 }
 
 type (
-	InitCallback   func()
-	ReportCallback func(string, *EventIntern)
-	EventCallback  func(ev *Event)
+	InitCallback     func()
+	ReportCallback   func(string, *EventIntern)
+	EventCallback    func(ev *Event)
+	ErrorCallback    func(err error)
+	ProgressCallback func(p *ScanProgress) // called every 1000 directories and at the end of the scan of a root
+	BatchCallback    func(evs []Event)     // called with the events of each read of the source
 )
 type EventType uint8
 
@@ -40,6 +70,10 @@ const (
 	LINK      = EventType(4)
 	ATTRIBUTE = EventType(5)
 	CHANGE    = EventType(6)
+	RESYNC    = EventType(7) // events were lost, the following events are the result of a rescan
+	OPEN      = EventType(8) // a file was opened, see Options.AccessEvents
+	READ      = EventType(9) // a file was read since it was opened
+	CLOSE     = EventType(10)
 )
 
 func (et EventType) String() (out string) {
@@ -56,6 +90,14 @@ func (et EventType) String() (out string) {
 		out = "ATTRIBUTE"
 	case CHANGE:
 		out = "CHANGE"
+	case RESYNC:
+		out = "RESYNC"
+	case OPEN:
+		out = "OPEN"
+	case READ:
+		out = "READ"
+	case CLOSE:
+		out = "CLOSE"
 	default:
 		out = "NOP"
 	}
@@ -66,50 +108,105 @@ func (et EventType) String() (out string) {
 Note that dictionary objects are all included in this structure.
 */
 type WT struct {
-	data          map[uint32]*WatchDirent // map of wd to watchDirents
-	inodes        map[StatKey]*Statid     // set of stat by inode
-	excludes      map[string]bool         // set of path names to be excluded
-	moved         map[uint32]*WatchDirent // wachDirents moved away from dir
-	reader        EventReader             // Event reader
-	root          WatchDirent             // directory entry containing all root paths
-	ncb           *NotifyCallbacks        // functions to be called
-	pendingCookie uint32                  // cookie form last movedFrom event
+	data          map[uint32]*WatchDirent       // map of wd to watchDirents
+	inodes        map[StatKey]*Statid           // set of stat by inode
+	excludes      map[string]bool               // set of path names to be excluded
+	globs         []ignoreRule                  // global exclude patterns
+	ignores       map[*WatchDirent][]ignoreRule // rules of ignore files by directory
+	ignoreFile    string                        // name of ignore files like ".gitignore"
+	rescan        bool                          // rescan tree after queue overflow
+	keepAlive     bool                          // continue processing without watches
+	mu            sync.Mutex                    // serializes event processing and changes of the roots
+	moved         map[uint32]*WatchDirent       // wachDirents moved away from dir
+	source        EventSource                   // Event source, usually an inotify EventReader
+	root          WatchDirent                   // directory entry containing all root paths
+	ncb           *NotifyCallbacks              // functions to be called
+	stream        *eventStream                  // event and error queues for channel consumers
+	pendingCookie uint32                        // cookie form last movedFrom event
+	backend       Backend                       // backend selection for new roots
+	pollInterval  time.Duration                 // interval of the poller
+	pollPaths     map[string]bool               // roots to be polled regardless of backend
+	pollRoots     map[*WatchDirent]bool         // roots observed by the poller
+	poller        *PollSource                   // secondary source for polled roots, nil if none
+	vanished      map[StatKey]*WatchDirent      // entries missing in a rescan, which may reappear
+	selfAttrib    bool                          // attribute changes of directories are reported only to themselves
+	pollUnwatched bool                          // poll directories, which cannot be watched by the source
+	limitWarning  *WatchLimitWarning            // pending report of exhausted watches
+	dirs          int                           // directories in the tree
+	snapshotFile  string                        // file for persisting the tree, none if empty
+	snapshot      []snapshotRecord              // loaded snapshot to be compared at the start of Run
+	snapshotErr   error                         // failure of loading the snapshot, reported by Run
+	scanWorkers   int                           // concurrent directory listings when scanning a root
+	scanning      *ScanProgress                 // state of the running scan of a root, nil if none
+	names         nameTable                     // shared names of entries
+	batching      bool                          // collect events for the Batch callback or Watcher.Batches
+	batch         []Event                       // events of the current read of the source
+	followRoots   bool                          // follow renamed roots instead of removing them
+	rootFds       map[*WatchDirent]int          // O_PATH file descriptors of the roots, if followed
+	persistRoots  bool                          // wait for deleted roots to be recreated
+	pendingRoots  map[string]uint32             // missing roots and the wd of their watched ancestor
+	ancestors     map[uint32][]string           // missing roots by the wd of their watched ancestor
+	atomicSave    bool                          // report files renamed over files as CHANGE
+	seq           uint64                        // sequence number of the last delivered event
+	lastTime      time.Time                     // time of the last delivered event
+	accessEvents  bool                          // report OPEN, READ and CLOSE of files
+	quietPeriod   time.Duration                 // report CHANGE of files without close after this time without writes
+	maxLatency    time.Duration                 // report CHANGE of continuously written files after this time
+	quiet         map[*Statid]*quietChange      // files modified without close, if quietPeriod is set
+	fileRoots     map[*WatchDirent][]string     // names of the file roots by their watched directory
 }
 
 // createWatchTable constructor
-func createWatchTable(mask uint32) (wt *WT) {
+func createWatchTable(source EventSource) (wt *WT) {
 	wt = &WT{}
-	wt.reader.Init(mask)
+	wt.source = source
 	wt.data = make(map[uint32]*WatchDirent)
 	wt.inodes = make(map[StatKey]*Statid)
 	wt.moved = make(map[uint32]*WatchDirent)
 	wt.excludes = make(map[string]bool)
-	wt.root = WatchDirent{elements: make(map[string]*WatchDirent)}
+	wt.ignores = make(map[*WatchDirent][]ignoreRule)
+	wt.pollPaths = make(map[string]bool)
+	wt.pollRoots = make(map[*WatchDirent]bool)
+	wt.vanished = make(map[StatKey]*WatchDirent)
+	wt.rootFds = make(map[*WatchDirent]int)
+	wt.fileRoots = make(map[*WatchDirent][]string)
+	wt.quiet = make(map[*Statid]*quietChange)
+	wt.pendingRoots = make(map[string]uint32)
+	wt.ancestors = make(map[uint32][]string)
+	wt.root = WatchDirent{elements: &dirElements{}}
 	return
 }
 
 /* destroy and free watchtable */
 func (wt *WT) cleanup() {
-	wt.reader.Close()
+	wt.closeSources()
+	for wde := range wt.rootFds {
+		wt.closeRoot(wde)
+	}
 	wt.data = nil
 	wt.inodes = nil
 	wt.excludes = nil
+	wt.ignores = nil
 	wt.moved = nil
 	wt.root.Cleanup()
 }
 
-/* print error text to stdout and perform error return. */
-func reporterror(err error, text string, ec int) {
-	fmt.Println(text, err, ec)
-	if ec != 0 {
-		panic(ec)
+// closeSources closes the event source and the poller.
+func (wt *WT) closeSources() {
+	wt.source.Close()
+	if wt.poller != nil {
+		wt.poller.Close()
 	}
 }
 
-/* print error text to stdout and perform error return. */
-func report(err error, a, b string, ec int) {
-	text := fmt.Sprintf("%s(\"%s\")", a, b)
-	reporterror(err, text, ec)
+/* pass a non-fatal error to the error callback and to the error stream. */
+func (wt *WT) reportError(err error) {
+	if wt.ncb != nil && wt.ncb.Error != nil {
+		wt.ncb.Error(err)
+	}
+	if wt.stream != nil {
+		wt.stream.pushError(err)
+	}
 }
 
 /*
@@ -118,16 +215,14 @@ func report(err error, a, b string, ec int) {
  */
 func (wt *WT) walkDirectory(wde *WatchDirent, action func(*WatchDirent, string, *WT)) (err error) {
 	dir := wde.Path()
-	file, err := os.Open(dir)
-	if err != nil {
-		report(err, "Open", dir, 0)
-		return
-	}
-	fis, err := file.Readdirnames(0)
+	fis, err := readDirNames(dir)
 	if err != nil {
-		report(err, "Readdirnames", dir, 0)
+		err = &PathError{Op: "readdirnames", Path: dir, Err: err}
+		wt.reportError(err)
 		return
 	}
+	wt.scanned(true)
+	wt.loadIgnoreFile(wde)
 	for _, name := range fis {
 		if name != "." && name != ".." {
 			action(wde, name, wt)
@@ -136,23 +231,103 @@ func (wt *WT) walkDirectory(wde *WatchDirent, action func(*WatchDirent, string,
 	return
 }
 
+/*
+ * Watch directory wde and then add its elements by action.
+ * The watch is added first, so no element created meanwhile is missed.
+ * Elements, which are listed and also reported by an event, are recognized by statNewFile.
+ */
+func (wt *WT) scanDirectory(wde *WatchDirent, action func(*WatchDirent, string, *WT)) {
+	if wt.addWatch(wde) == nil {
+		wt.walkDirectory(wde, action)
+	}
+}
+
+// readDirNames reads all names of directory dir.
+func readDirNames(dir string) (names []string, err error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	names, err = file.Readdirnames(0)
+	file.Close()
+	return
+}
+
 /*
  * Add a path to observed objects.
  * Dict<int, char*> stores the association from watch id to pathname
  * of observed object.
  * Events according to mask will be delivered.
  */
-func (wt *WT) addWatch(wde *WatchDirent) {
+func (wt *WT) addWatch(wde *WatchDirent) error {
 	path := wde.Path()
-	wd, err := wt.reader.addWatch(path)
+	wd, err := wt.watchSource(wde).AddWatch(path)
+	return wt.watchAdded(wde, path, wd, err)
+}
+
+// watchSource returns the source, which observes directory wde.
+func (wt *WT) watchSource(wde *WatchDirent) EventSource {
+	if wt.isPolled(wde) {
+		return wt.poller
+	}
+	return wt.source
+}
+
+/*
+ * Register the watch descriptor wd of directory wde or report the error of adding it.
+ */
+func (wt *WT) watchAdded(wde *WatchDirent, path string, wd uint32, err error) error {
+	if err != nil && errors.Is(err, ErrWatchLimit) {
+		wd, err = wt.watchLimitReached(path, err)
+	}
 	wde.wd = wd
 	if err != nil {
-		report(err, "inotifyAddWatch", path, 0)
-		return
+		wt.reportError(err)
+		return err
+	}
+	if wd != 0 {
+		wt.data[wde.wd] = wde
 	}
-	wt.data[wde.wd] = wde
 	//D fmt.Printf("node+ %d %s\n", wd, path)
-	return
+	return nil
+}
+
+/*
+ * Record a failure to add a watch for lack of watches, which is reported
+ * by reportWatchLimit. The directory is polled instead, if requested.
+ */
+func (wt *WT) watchLimitReached(path string, err error) (wd uint32, err2 error) {
+	w := wt.limitWarning
+	if w == nil {
+		w = &WatchLimitWarning{Path: path, Err: err, Polled: wt.pollUnwatched}
+		wt.limitWarning = w
+	}
+	w.Unwatched++
+	if !wt.pollUnwatched {
+		return 0, nil
+	}
+	if wt.poller == nil {
+		wt.poller = NewPollSource(wt.pollInterval)
+	}
+	return wt.poller.AddWatch(path)
+}
+
+/*
+ * Report the pending WatchLimitWarning with the number of directories in the tree.
+ */
+func (wt *WT) reportWatchLimit() {
+	w := wt.limitWarning
+	if w == nil {
+		return
+	}
+	wt.limitWarning = nil
+	w.Limit = maxUserWatches()
+	w.Needed = wt.dirs
+	if w.Path == "" {
+		// no inotify instance at all
+		w.Unwatched = w.Needed
+	}
+	wt.reportError(w)
 }
 
 /*
@@ -160,9 +335,13 @@ func (wt *WT) addWatch(wde *WatchDirent) {
  */
 func (wt *WT) removeWatch(wde *WatchDirent) {
 	wd := wde.wd
-	if wd > 0 {
+	if wd > 0 && wt.ancestors[wd] == nil {
 		//D fmt.Printf("node- %d %s\n", wd, wde.Path())
-		err := wt.reader.removeWatch(wd)
+		var source EventSource = wt.source
+		if wt.poller != nil && wd >= pollWdBase {
+			source = wt.poller
+		}
+		err := source.RemoveWatch(wd)
 		if err != nil {
 			// report(err, "inotify_rm_watch", strconv.FormatInt(int64(wd), 10), 0)
 		}
@@ -196,13 +375,17 @@ func (wt *WT) removeHierarchyRec(wde *WatchDirent) {
 	if wde.wd > 0 {
 		wt.removeWatch(wde)
 	}
-	if wde.elements != nil {
-		for k, wdechild := range wde.elements {
+	if elements := wde.elements; elements != nil {
+		wde.elements = nil // the children need not unlink themselves
+		wt.dirs--
+		for _, wdechild := range elements.all() {
 			wt.removeHierarchyRec(wdechild)
-			delete(wde.elements, k)
 		}
-		wde.elements = nil
+		delete(wt.ignores, wde)
 	}
+	delete(wt.pollRoots, wde)
+	delete(wt.fileRoots, wde)
+	wt.closeRoot(wde)
 	wt.dequeueAndMaybeFreeStatus(wde)
 	wt.destroyAndUnlink(wde)
 }
@@ -212,7 +395,7 @@ func (wt *WT) unlink(wde *WatchDirent) {
 	if wde.cookie != 0 {
 		delete(wt.moved, wde.cookie)
 	} else if wde.parent != nil && wde.parent.elements != nil {
-		delete(wde.parent.elements, wde.name)
+		wde.parent.elements.remove(wde.name)
 	}
 }
 
@@ -240,12 +423,36 @@ func (wt *WT) statNewFile(wde *WatchDirent, name string) *WatchDirent {
 	}
 
 	path := wde.Path(name)
-	statidBuffer := Statid{}
+	var stat syscall.Stat_t
 
-	if err := syscall.Lstat(path, &statidBuffer.filestat); err != nil {
-		report(err, "statNewFilel.stat", path, 0)
+	if err := syscall.Lstat(path, &stat); err != nil {
+		if err != syscall.ENOENT {
+			wt.reportError(&PathError{Op: "lstat", Path: path, Err: err})
+		}
+		// otherwise removed again before it could be examined
+		return nil
+	}
+	return wt.newEntry(wde, name, &Statid{filestat: newFileStat(&stat)})
+}
+
+/*
+ * Insert the entry name with the stat data of statidBuffer into directory wde,
+ * unless it is excluded or already known.
+ */
+func (wt *WT) newEntry(wde *WatchDirent, name string, statidBuffer *Statid) *WatchDirent {
+	isDir := statidBuffer.filestat.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	if wt.excluded(wde, name, isDir) {
 		return nil
 	}
+	if wdeold := wde.elements.get(name); wdeold != nil {
+		if wdeold.statid.key() == statidBuffer.key() {
+			// already known, e.g. listed by a scan and reported by an event
+			return nil
+		}
+		// replaced by a different file
+		wt.removeHierarchy(wdeold)
+		wt.callbackDelete(&EventIntern{}, wdeold)
+	}
 	if statidBuffer.filestat.Mode&WATCHED != 0 {
 		var savedfirst *WatchDirent = nil
 		statkey := statidBuffer.key()
@@ -254,14 +461,17 @@ func (wt *WT) statNewFile(wde *WatchDirent, name string) *WatchDirent {
 			savedfirst = statid.first
 			statid.filestat = statidBuffer.filestat
 		} else {
-			wt.inodes[statkey] = &statidBuffer
-			statid = &statidBuffer
+			wt.inodes[statkey] = statidBuffer
+			statid = statidBuffer
 		}
-		wdenew := createWatchDirent(wde, name, statid.filestat.Mode&syscall.S_IFDIR != 0)
+		wdenew := createWatchDirent(wde, wt.names.intern(name), statid.filestat.Mode&syscall.S_IFDIR != 0)
 		wdenew.statid = statid
 		wdenew.next = savedfirst
-		wde.elements[name] = wdenew
+		wde.elements.set(wdenew)
 		statid.first = wdenew
+		if wdenew.elements != nil {
+			wt.dirs++
+		}
 		return wdenew
 	}
 	return nil
@@ -276,10 +486,11 @@ func (wt *WT) statNewFile(wde *WatchDirent, name string) *WatchDirent {
  */
 func addWatches(wde *WatchDirent, name string, wt *WT) {
 	wdenew := wt.statNewFile(wde, name)
+	if wdenew != nil {
+		wt.scanned(false)
+	}
 	if wdenew != nil && wdenew.statid.filestat.Mode&syscall.S_IFDIR != 0 {
-		if wt.walkDirectory(wdenew, addWatches) == nil {
-			wt.addWatch(wdenew)
-		}
+		wt.scanDirectory(wdenew, addWatches)
 	}
 }
 
@@ -292,9 +503,7 @@ func addWatches2(wde *WatchDirent, name string, wt *WT) {
 	isDir := wdenew.statid.filestat.Mode&syscall.S_IFDIR != 0
 	wt.callback(CREATE, &EventIntern{}, wdenew, false)
 	if wdenew != nil && isDir {
-		if wt.walkDirectory(wdenew, addWatches2) == nil {
-			wt.addWatch(wdenew)
-		}
+		wt.scanDirectory(wdenew, addWatches2)
 	}
 }
 
@@ -309,111 +518,289 @@ func (wt *WT) debug(event *EventIntern) {
 	}
 }
 
-// callback calls a callback function with an additional string parameter
-func (wt *WT) callback(et EventType, event *EventIntern, wde *WatchDirent, data bool, altpath ...string) {
+// callback calls a callback function with the previous path of a MOVE as additional parameter
+func (wt *WT) callback(et EventType, event *EventIntern, wde *WatchDirent, data bool, oldpath ...string) {
+	wt.deliver(newEvent(et, event, wde, data, oldpath...))
+}
 
-	if wt.ncb != nil && wt.ncb.Event != nil {
-		var ev Event
-		ev.EventType = et
-		ev.IsDir = wde.statid.filestat.Mode&syscall.S_IFDIR != 0
-		ev.DataModified = data
-		ev.Path = wde.Path()
-		if len(altpath) > 0 {
-			ev.Path2 = altpath[0]
+// newEvent describes the event of type et for wde.
+func newEvent(et EventType, event *EventIntern, wde *WatchDirent, data bool, oldpath ...string) *Event {
+	var ev Event
+	ev.EventType = et
+	ev.IsDir = wde.statid.filestat.Mode&syscall.S_IFDIR != 0
+	ev.DataModified = data
+	ev.Path = wde.Path()
+	if len(oldpath) > 0 {
+		ev.OldPath = oldpath[0]
+	}
+	for link := wde.statid.first; link != nil; link = link.next {
+		if link != wde {
+			ev.OtherLinks = append(ev.OtherLinks, link.Path())
 		}
-		ev.Key = wde.statid.key()
-		wt.ncb.Event(&ev)
 	}
+	ev.Key = wde.statid.key()
+	ev.Pid = event.Pid
+	ev.Time = event.Time
+	ev.setStat(&wde.statid.filestat)
+	return &ev
+}
+
+// deliver passes the event to the event callback and to the event stream
+func (wt *WT) deliver(ev *Event) {
+	wt.seq++
+	ev.Seq = wt.seq
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Time.Before(wt.lastTime) {
+		// events found by a scan or timer may precede events read before
+		ev.Time = wt.lastTime
+	}
+	wt.lastTime = ev.Time
+	if wt.ncb != nil && wt.ncb.Event != nil {
+		wt.ncb.Event(ev)
+	}
+	if wt.stream != nil {
+		wt.stream.pushEvent(ev)
+	}
+	if wt.batching {
+		wt.batch = append(wt.batch, *ev)
+	}
+}
+
+// startBatching enables collecting the events, if there is a consumer of batches.
+func (wt *WT) startBatching() {
+	wt.batching = wt.ncb != nil && wt.ncb.Batch != nil || wt.stream != nil && wt.stream.batching()
+}
+
+// flushBatch passes the events collected since the last flush as one batch.
+func (wt *WT) flushBatch() {
+	if len(wt.batch) == 0 {
+		return
+	}
+	batch := wt.batch
+	wt.batch = nil
+	if wt.ncb != nil && wt.ncb.Batch != nil {
+		wt.ncb.Batch(batch)
+	}
+	if wt.stream != nil {
+		wt.stream.pushBatch(batch)
+	}
+}
+
+// buffered is true, if the next event of a source is available without reading.
+func (wt *WT) buffered() bool {
+	if bs, ok := wt.source.(bufferedSource); ok && bs.buffered() {
+		return true
+	}
+	return wt.poller != nil && wt.poller.buffered()
 }
 
 // process the IN_..._SELF events (which have no Name in InotifyEvent).
-func (wt *WT) processSelf(event *EventIntern, wde *WatchDirent) int {
+func (wt *WT) processSelf(event *EventIntern, wde *WatchDirent) error {
 	mask := event.Mask
+	if _, ok := wt.fileRoots[wde]; ok {
+		return wt.processFileDir(event, wde)
+	}
 
 	switch {
 	case mask&syscall.IN_IGNORED != 0:
 		//D fmt.Printf("node- %d %s\n", event.Wd, wde.Path())
 		delete(wt.data, event.Wd)
 	case mask&syscall.IN_MOVE_SELF != 0:
-		// move-to is missing or not subfile of supervised directory */
-		if wde.cookie > 0 || wde.parent.wd == 0 {
+		switch {
+		case wde.cookie == 0 && wde.parent == &wt.root && wt.followRoots && wt.followRoot(event, wde):
+			// still watched at its new path
+		case wde.cookie > 0 || wde.parent.wd == 0:
+			// move-to is missing or not subfile of supervised directory */
 			wt.removeHierarchy(wde)
 			event.Mask |= syscall.IN_ISDIR
 			wt.pendingCookie = 0
 			wt.callbackDelete(event, wde)
+			if wde.parent == &wt.root && wt.persistRoots {
+				wt.armRoot(wde.name)
+			}
 		}
 	case mask&syscall.IN_DELETE_SELF != 0:
 		if wde.parent.wd == 0 {
+			// inotify removes the watch itself, other sources may not
+			wt.removeWatch(wde)
 			wde.wd = 0
 			wt.removeHierarchy(wde)
 			event.Mask |= syscall.IN_ISDIR
 			wt.callback(DELETE, event, wde, true)
+			if wt.persistRoots {
+				wt.armRoot(wde.name)
+			}
 		}
 	case mask&syscall.IN_ATTRIB != 0:
-		if wde.parent.wd == 0 {
-			wde.wd = 0
+		if wde.parent.wd == 0 || wt.selfAttrib {
+			// a root keeps its watch, so it is removed with the root
 			return wt.processAttribute(event, wde)
 		}
 	}
 
-	return 0
+	return nil
 }
 
 // processCreate event
-func (wt *WT) processCreate(event *EventIntern, wde *WatchDirent) int {
+func (wt *WT) processCreate(event *EventIntern, wde *WatchDirent) error {
 	mask := event.Mask
 	name := event.Name
 	wdenew := wt.statNewFile(wde, name)
 	if wdenew == nil {
-		return 0
+		return nil
 	}
 	createEvent := event.Mask&syscall.IN_CREATE != 0
 	if wdenew.next != nil && createEvent {
-		wt.callback(LINK, event, wdenew, false, wdenew.next.Path())
+		wt.callback(LINK, event, wdenew, false)
 	} else {
 		wt.callback(CREATE, event, wdenew, true)
 	}
 	if mask&syscall.IN_ISDIR != 0 {
-		if wt.walkDirectory(wdenew, addWatches2) == nil {
-			wt.addWatch(wdenew)
-		}
+		wt.scanDirectory(wdenew, addWatches2)
 		//D wt.printTable("p create")
 	}
-	return 0
+	return nil
 }
 
 // processMovedFrom event
-func (wt *WT) processMovedFrom(event *EventIntern, wdenew *WatchDirent) int {
+func (wt *WT) processMovedFrom(event *EventIntern, wdenew *WatchDirent) error {
 	if wdenew == nil {
-		return 0
+		return nil
 	}
 	wdenew.cookie = event.Cookie
 	wt.pendingCookie = wdenew.cookie
-	delete(wdenew.parent.elements, wdenew.name)
+	wdenew.parent.elements.remove(wdenew.name)
 	wt.moved[wdenew.cookie] = wdenew
 	wdenew.Dequeue()
-	return 0
+	return nil
 }
 
 // processMovedTo event
-func (wt *WT) processMovedTo(event *EventIntern, wde *WatchDirent) int {
+func (wt *WT) processMovedTo(event *EventIntern, wde *WatchDirent) error {
 
 	wdenew, ok := wt.moved[event.Cookie]
 	if !ok {
 		// no corresponding movedFrom
+		if wt.atomicSave && wt.saveUntracked(event, wde) {
+			return nil
+		}
 		return wt.processCreate(event, wde)
 	} else {
-		oldpath := wdenew.Path()
-		wdenew.cookie = 0
-		wdenew.name = event.Name
-		wdenew.parent = wde
-		wde.elements[wdenew.name] = wdenew
-		statid := wdenew.statid
-		wdenew.next = statid.first
-		statid.first = wdenew
-		wt.callback(MOVE, event, wdenew, false, oldpath)
+		delete(wt.moved, event.Cookie)
+		if wt.pendingCookie == event.Cookie {
+			wt.pendingCookie = 0
+		}
+		isDir := wdenew.statid.filestat.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		if wt.excluded(wde, event.Name, isDir) {
+			// moved to an excluded path - same as moved out of the tree
+			wt.removeHierarchy(wdenew)
+			wt.callbackDelete(event, wdenew)
+			return nil
+		}
+		if wdeold := wde.elements.get(event.Name); wt.atomicSave && isSavedOver(wdeold, wdenew.statid) {
+			wt.removeHierarchy(wdeold)
+			wt.link(wdenew, wde, event.Name)
+			wt.callbackSaved(event, wdenew, wdeold.statid.key())
+			return nil
+		}
+		wt.moveTo(event, wdenew, wde, event.Name)
 	}
-	return 0
+	return nil
+}
+
+/*
+ * Process a file, which was renamed over the file of the same name in wde from outside
+ * the tree or from an excluded name. Return false, if it did not replace a file.
+ */
+func (wt *WT) saveUntracked(event *EventIntern, wde *WatchDirent) bool {
+	wdeold := wde.elements.get(event.Name)
+	var stat syscall.Stat_t
+	if wdeold == nil || syscall.Lstat(wde.Path(event.Name), &stat) != nil {
+		return false
+	}
+	statid := &Statid{filestat: newFileStat(&stat)}
+	if !isSavedOver(wdeold, statid) || wdeold.statid.key() == statid.key() {
+		return false
+	}
+	wt.removeHierarchy(wdeold)
+	wdenew := wt.newEntry(wde, event.Name, statid)
+	if wdenew == nil {
+		wt.callbackDelete(event, wdeold)
+		return true
+	}
+	wt.callbackSaved(event, wdenew, wdeold.statid.key())
+	return true
+}
+
+// isSavedOver is true, if the regular file wdeold is replaced by another regular file with statid.
+func isSavedOver(wdeold *WatchDirent, statid *Statid) bool {
+	return wdeold != nil && wdeold.statid != statid &&
+		wdeold.statid.filestat.Mode&syscall.S_IFMT == syscall.S_IFREG &&
+		statid.filestat.Mode&syscall.S_IFMT == syscall.S_IFREG
+}
+
+// callbackSaved reports the atomic save of wde, which replaced the inode oldkey, as CHANGE.
+func (wt *WT) callbackSaved(event *EventIntern, wde *WatchDirent, oldkey StatKey) {
+	ev := newEvent(CHANGE, event, wde, true)
+	ev.OldKey = oldkey
+	wt.deliver(ev)
+}
+
+// moveTo links wdenew, which has been detached from its old parent,
+// as name into directory wde and reports the MOVE.
+func (wt *WT) moveTo(event *EventIntern, wdenew *WatchDirent, wde *WatchDirent, name string) {
+	oldpath := wdenew.Path()
+	if wdeold := wde.elements.get(name); wdeold != nil && wdeold != wdenew {
+		// a link of the same inode is a duplicate listed by a scan, others are replaced
+		if wdeold.statid == wdenew.statid {
+			wt.removeDuplicate(wdeold, wdenew)
+		} else {
+			wt.removeHierarchy(wdeold)
+			wt.callbackDelete(event, wdeold)
+		}
+	}
+	wt.link(wdenew, wde, name)
+	wt.callback(MOVE, event, wdenew, false, oldpath)
+}
+
+/*
+ * Remove the duplicate wdeold of the moved entry wdenew, which has been listed by a scan.
+ * inotify has one watch per inode, so the directories of the duplicate share their
+ * watches with the moved directories. These watches are handed over instead of removed.
+ */
+func (wt *WT) removeDuplicate(wdeold *WatchDirent, wdenew *WatchDirent) {
+	wt.handOverWatch(wdeold, wdenew)
+	wdeold.Walk(func(wde *WatchDirent, depth int) {
+		for link := wde.statid.first; link != nil && wde.wd != 0; link = link.next {
+			if link != wde {
+				wt.handOverWatch(wde, link)
+			}
+		}
+	}, 0)
+	wt.removeHierarchy(wdeold)
+}
+
+// handOverWatch moves the watch of wde to its link, unless the link has another watch.
+func (wt *WT) handOverWatch(wde *WatchDirent, link *WatchDirent) {
+	if wde.wd != 0 && (link.wd == 0 || link.wd == wde.wd) {
+		link.wd = wde.wd
+		wt.data[link.wd] = link
+		wde.wd = 0
+	}
+}
+
+// link inserts the detached wdenew as name into directory wde.
+func (wt *WT) link(wdenew *WatchDirent, wde *WatchDirent, name string) {
+	wdenew.cookie = 0
+	wdenew.name = wt.names.intern(name)
+	wdenew.parent = wde
+	wde.elements.set(wdenew)
+	statid := wdenew.statid
+	wdenew.next = statid.first
+	statid.first = wdenew
+	wt.inodes[statid.key()] = statid
 }
 
 // destroyAndUnlink deletes this wde from all wt dictionaries.
@@ -425,101 +812,118 @@ func (wt *WT) destroyAndUnlink(wde *WatchDirent) {
 }
 
 // processDelete event
-func (wt *WT) processDelete(event *EventIntern, wdenew *WatchDirent) int {
+func (wt *WT) processDelete(event *EventIntern, wdenew *WatchDirent) error {
 
 	if wdenew == nil {
-		return 0
+		return nil
 	}
 	wt.callbackDelete(event, wdenew)
 	wt.removeHierarchy(wdenew)
-	delete(wdenew.parent.elements, wdenew.name)
-	return 0
+	wdenew.parent.elements.remove(wdenew.name)
+	return nil
 }
 
 // call callback for delete event
-// additional alternative path when file content preserved
+// the data are not modified, if the file content is preserved by another link
 func (wt *WT) callbackDelete(event *EventIntern, wde *WatchDirent) {
-	alt := wde.Alternative()
-	if alt == nil {
-		wt.callback(DELETE, event, wde, true)
-	} else {
-		wt.callback(DELETE, event, wde, false, alt.Path())
-	}
+	wt.callback(DELETE, event, wde, wde.Alternative() == nil)
 }
 
 // modifyComplete is called after a file contents change is concluded.
-func (wt *WT) modifyComplete(event *EventIntern, wde *WatchDirent) (res int) {
+func (wt *WT) modifyComplete(event *EventIntern, wde *WatchDirent) (err error) {
 	if wde != nil && wde.statid.isChangeComplete() {
+		wt.restat(wde)
 		wt.callback(CHANGE, event, wde, true)
 		wde.statid.resetChanged()
+		delete(wt.quiet, wde.statid)
 	}
 	return
 }
 
 // attributeComplete is called after each attribute change event
-func (wt *WT) attributeComplete(event *EventIntern, wde *WatchDirent) (res int) {
+func (wt *WT) attributeComplete(event *EventIntern, wde *WatchDirent, changed AttrChange) (err error) {
 	if wde != nil && wde.statid.isAttributeComplete() {
-		wt.callback(ATTRIBUTE, event, wde, false)
+		ev := newEvent(ATTRIBUTE, event, wde, false)
+		ev.Changed = changed
+		wt.deliver(ev)
 		wde.statid.resetAttribute()
 	}
 	return
 }
 
 // processModify event - only smask bit is set
-func (wt *WT) processModify(event *EventIntern, wdenew *WatchDirent) (res int) {
-	wdenew.statid.smask |= syscall.IN_MODIFY
+func (wt *WT) processModify(event *EventIntern, wdenew *WatchDirent) (err error) {
+	if wdenew != nil {
+		wdenew.statid.smask |= syscall.IN_MODIFY
+		wt.noteModify(wdenew.statid, event.Time)
+	}
 	return
 }
 
 // processClose Event - eventually conclude modification of file contents
-func (wt *WT) processClose(event *EventIntern, wdenew *WatchDirent) (res int) {
-	if wdenew.statid.smask&syscall.IN_MODIFY != 0 {
+func (wt *WT) processClose(event *EventIntern, wdenew *WatchDirent) (err error) {
+	if wdenew != nil && wdenew.statid.smask&syscall.IN_MODIFY != 0 {
 		wdenew.statid.smask |= syscall.IN_CLOSE_WRITE
-		res = wt.modifyComplete(event, wdenew)
+		err = wt.modifyComplete(event, wdenew)
 	}
 	return
 }
 
 // processAttribute event
-func (wt *WT) processAttribute(event *EventIntern, wdenew *WatchDirent) (res int) {
-	wdenew.statid.smask |= syscall.IN_ATTRIB
-	res = wt.attributeComplete(event, wdenew)
+func (wt *WT) processAttribute(event *EventIntern, wdenew *WatchDirent) (err error) {
+	if wdenew != nil {
+		wdenew.statid.smask |= syscall.IN_ATTRIB
+		err = wt.attributeComplete(event, wdenew, wt.restat(wdenew))
+	}
 	return
 }
 
 // processSubfile seledct the proper event processing function
-func (wt *WT) processSubfile(event *EventIntern, wde *WatchDirent) (res int) {
+func (wt *WT) processSubfile(event *EventIntern, wde *WatchDirent) (err error) {
 	mask := event.Mask
 	switch {
 	case mask&syscall.IN_CREATE != 0:
-		res = wt.processCreate(event, wde)
+		err = wt.processCreate(event, wde)
 	case mask&syscall.IN_MOVED_FROM != 0:
-		res = wt.processMovedFrom(event, wde.child(event))
+		err = wt.processMovedFrom(event, wt.child(wde, event))
 	case mask&syscall.IN_MOVED_TO != 0:
-		res = wt.processMovedTo(event, wde)
+		err = wt.processMovedTo(event, wde)
 	case mask&syscall.IN_DELETE != 0:
-		res = wt.processDelete(event, wde.child(event))
+		err = wt.processDelete(event, wt.child(wde, event))
 	case mask&syscall.IN_MODIFY != 0:
-		res = wt.processModify(event, wde.child(event))
+		err = wt.processModify(event, wt.child(wde, event))
 	case mask&syscall.IN_CLOSE_WRITE != 0:
-		res = wt.processClose(event, wde.child(event))
+		err = wt.processClose(event, wt.child(wde, event))
 	case mask&syscall.IN_ATTRIB != 0:
-		res = wt.processAttribute(event, wde.child(event))
+		err = wt.processAttribute(event, wt.child(wde, event))
 	}
 	//D fmt.Printf("%s%s %#x %#x \n", "subfile", wde.name,wde.statid.address(),  wde.statid.smask)
 	return
 }
 
+// child looks up the name of the event in the elements of wde.
+// A missing element is reported as ErrMissingElement, unless it is excluded,
+// and nil is returned.
+func (wt *WT) child(wde *WatchDirent, event *EventIntern) *WatchDirent {
+	wdenew := wde.child(event)
+	if wdenew == nil && !wt.excluded(wde, event.Name, event.Mask&syscall.IN_ISDIR != 0) {
+		var stat syscall.Stat_t
+		path := wde.Path(event.Name)
+		if syscall.Lstat(path, &stat) != syscall.ENOENT {
+			// not removed before it could be examined
+			wt.reportError(&PathError{Op: "lookup", Path: path, Err: ErrMissingElement})
+		}
+	}
+	return wdenew
+}
+
 /*
  * Process a single event.
- * The function returns positive integer return value to indicate the
- * processing loop to be stopped.
- * return 1: No more directories/files to be watched
- * return 2: For overflow of event queue
- * return 3: EventIntern with zero watch descriptor
- * return 4: Registered path is NULL
+ * The function returns an error to indicate the processing loop to be stopped.
+ * ErrQueueOverflow: For overflow of event queue, unless the tree is rescanned
+ * ErrZeroWatch: EventIntern with zero watch descriptor
  */
-func (wt *WT) processEvent(event *EventIntern) (res int) {
+func (wt *WT) processEvent(event *EventIntern) (err error) {
 
 	wt.simulateMovedToEvent(event) // test for missing movedTo event when file moved out
 	if event == nil {
@@ -527,31 +931,109 @@ func (wt *WT) processEvent(event *EventIntern) (res int) {
 	}
 	name := event.Name
 	mask := event.Mask
+	if mask&inRescanDone != 0 {
+		wt.finishRescan()
+		return
+	}
+	if _, ok := wt.ancestors[event.Wd]; ok {
+		wt.processAncestor(event.Wd)
+		if wt.data[event.Wd] == nil {
+			return
+		}
+	}
+	if mask&inRescan != 0 {
+		if wde := wt.data[event.Wd]; wde != nil {
+			wt.rescanDir(wde, false)
+		}
+		return
+	}
 	wt.debug(event)
 	if mask&syscall.IN_Q_OVERFLOW != 0 {
-		report(nil, "processEvent", "IN_Q_OVERFLOW", 0)
-		return 2
+		if wt.rescan {
+			wt.resync()
+			return
+		}
+		return ErrQueueOverflow
 	}
 	if event.Wd == 0 {
-		report(nil, "processEvent", "wd == 0", 0)
-		return 3
+		return ErrZeroWatch
 	}
 
 	wde, ok := wt.data[event.Wd]
 	if !ok {
-		return 0 // silently ignore
+		return nil // silently ignore
 	}
 
 	if len(name) == 0 {
-		res = wt.processSelf(event, wde)
+		err = wt.processSelf(event, wde)
 	} else {
-		res = wt.processSubfile(event, wde)
+		wt.processAccess(event, wde, syscall.IN_OPEN)
+		for _, ev := range wt.splitEvent(event, wde) {
+			if err = wt.processSubfile(ev, wde); err != nil {
+				break
+			}
+		}
+		wt.processAccess(event, wde, syscall.IN_ACCESS|closeBits)
+		if name == wt.ignoreFile && wde.elements != nil {
+			wt.loadIgnoreFile(wde)
+		}
 	}
 	//D wt.printTable("after event")
-	if res == 0 && len(wt.data) <= 0 {
-		res = 1
+	return
+}
+
+// event bits, which may be merged into one event by fanotify
+const (
+	goneBits   = syscall.IN_MOVED_FROM | syscall.IN_DELETE
+	appearBits = syscall.IN_CREATE | syscall.IN_MOVED_TO
+	changeBits = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE
+)
+
+/*
+ * Split an event with several bits into a sequence of events in a plausible order.
+ * If the element is tracked, it has gone first. If it exists now, it has appeared
+ * afterwards, and only then it can have been changed.
+ */
+func (wt *WT) splitEvent(event *EventIntern, wde *WatchDirent) []*EventIntern {
+	mask := event.Mask
+	bits := mask & (goneBits | appearBits | changeBits)
+	if bits&(bits-1) == 0 {
+		return []*EventIntern{event}
+	}
+	var stat syscall.Stat_t
+	exists := syscall.Lstat(wde.Path(event.Name), &stat) == nil
+	tracked := wde.elements.get(event.Name) != nil
+	var order []uint32
+	if tracked && bits&goneBits != 0 {
+		if bits&syscall.IN_MOVED_FROM != 0 && event.Cookie != 0 {
+			order = append(order, syscall.IN_MOVED_FROM)
+		} else {
+			order = append(order, syscall.IN_DELETE)
+		}
+		tracked = false
+	}
+	if exists {
+		if !tracked && bits&appearBits != 0 {
+			if bits&(syscall.IN_CREATE|syscall.IN_MOVED_FROM) == 0 {
+				order = append(order, syscall.IN_MOVED_TO)
+			} else {
+				order = append(order, syscall.IN_CREATE)
+			}
+			tracked = true
+		}
+		for _, bit := range []uint32{syscall.IN_MODIFY, syscall.IN_ATTRIB, syscall.IN_CLOSE_WRITE} {
+			if tracked && bits&bit != 0 {
+				order = append(order, bit)
+			}
+		}
 	}
-	return res
+	events := make([]*EventIntern, len(order))
+	for i, bit := range order {
+		ev := *event
+		ev.Mask = bit | mask&^bits
+		events[i] = &ev
+	}
+	return events
 }
 
 func (wt *WT) simulateMovedToEvent(event *EventIntern) {
@@ -605,7 +1087,7 @@ func (wde *WatchDirent) Walk(action func(*WatchDirent, int), depth int) {
 	if wde != nil && wde.statid != nil {
 		action(wde, depth)
 	}
-	for _, wdenew := range wde.elements {
+	for _, wdenew := range wde.elements.all() {
 		wdenew.Walk(action, depth+1)
 	}
 }
@@ -619,59 +1101,141 @@ func (wt *WT) printTable(text string) {
 
 /*
  * Setup processing.
- * Return initialised watchtable object on heap (to be freed at exit.
+ * Excludes are registered first, so they apply during the scan of the includes.
+ * Includes, which cannot be watched, are reported as non-fatal errors.
  */
-func fillWatchTable(inv []string, exv []string, mask uint32, ncb *NotifyCallbacks) (wt *WT) {
+func fillWatchTable(wt *WT, inv []string, exv []string) (err error) {
 
-	wt = createWatchTable(mask)
-	if wt == nil {
-		return
-	}
-	wt.ncb = ncb
-	for _, pa := range inv {
-		ppath, err := filepath.Abs(filepath.Clean(pa))
-		if err != nil {
-			report(nil, "No include file", pa, 2)
-			return
-		}
-		wde := wt.statNewFile(&wt.root, ppath)
-		if wde != nil && wt.walkDirectory(wde, addWatches) == nil {
-			fmt.Printf("Include %q\n", ppath)
-			wt.addWatch(wde)
-		}
-	}
 	for _, pa := range exv {
+		if isPattern(pa) {
+			wt.addExcludePattern(pa)
+			continue
+		}
 		ppath, err := filepath.Abs(filepath.Clean(pa))
 		if err != nil {
-			report(nil, "No exclude file", pa, 2)
-			return
+			return &PathError{Op: "exclude", Path: pa, Err: err}
 		}
-		fmt.Printf("Exclude %q\n", ppath)
 		wt.addExclude(ppath)
 	}
+	for _, pa := range inv {
+		if _, err := wt.addRoot(pa); err != nil {
+			wt.reportError(err)
+		}
+	}
 	//D wt.printTable("init watchtable")
-	return wt
+	return nil
 }
 
 /*
- * Perform processing loop.
+ * Add a new root to the watchtable and scan its hierarchy.
+ * A root must neither contain nor be contained in another root.
+ * With persistent roots, a missing root is added when it appears.
  */
-func (wt *WT) internalProcessNotify() (stop int) {
+func (wt *WT) addRoot(pa string) (wde *WatchDirent, err error) {
+	ppath, err := filepath.Abs(filepath.Clean(pa))
+	if err != nil {
+		return nil, &PathError{Op: "include", Path: pa, Err: err}
+	}
+	for name := range wt.rootPaths() {
+		if overlapping(name, ppath) {
+			return nil, &PathError{Op: "include", Path: ppath, Err: ErrOverlappingRoot}
+		}
+	}
+	var stat syscall.Stat_t
+	if err = syscall.Lstat(ppath, &stat); err != nil {
+		if wt.persistRoots && (err == syscall.ENOENT || err == syscall.ENOTDIR) {
+			wt.armRoot(ppath)
+			return nil, nil
+		}
+		return nil, &PathError{Op: "lstat", Path: ppath, Err: err}
+	}
+	return wt.insertRoot(ppath, stat.Mode&syscall.S_IFMT == syscall.S_IFDIR)
+}
 
-	if len(wt.data) == 0 {
-		stop = 1
+// insertRoot adds the existing path ppath as root and scans it.
+func (wt *WT) insertRoot(ppath string, isDir bool) (wde *WatchDirent, err error) {
+	if !isDir {
+		return wt.insertFileRoot(ppath)
 	}
-	for stop == 0 {
-		ev, err := wt.reader.NextEventWait(time.Second * 5)
-		if err != nil {
-			return 1
+	wde = wt.statNewFile(&wt.root, ppath)
+	if wde == nil {
+		return nil, &PathError{Op: "include", Path: ppath, Err: ErrExcluded}
+	}
+	wt.selectBackend(wde)
+	if wt.followRoots {
+		wt.openRoot(wde)
+	}
+	wt.scanRoot(wde)
+	wt.reportWatchLimit()
+	return
+}
+
+/*
+ * Remove a root and its hierarchy from the watchtable.
+ */
+func (wt *WT) removeRoot(pa string) error {
+	ppath, err := filepath.Abs(filepath.Clean(pa))
+	if err != nil {
+		return &PathError{Op: "remove", Path: pa, Err: err}
+	}
+	wde := wt.root.elements.get(ppath)
+	if _, ok := wt.pendingRoots[ppath]; ok {
+		wt.releaseAncestor(ppath)
+		return nil
+	}
+	if wt.removeFileRoot(ppath) {
+		return nil
+	}
+	if _, ok := wt.fileRoots[wde]; wde == nil || ok {
+		return &PathError{Op: "remove", Path: ppath, Err: ErrUnknownRoot}
+	}
+	wt.removeHierarchy(wde)
+	return nil
+}
+
+// finished is true, if there is nothing left to watch.
+func (wt *WT) finished() bool {
+	return len(wt.data) == 0 && len(wt.pendingRoots) == 0 && !wt.keepAlive
+}
+
+/*
+ * Perform processing loop.
+ * Return nil if there is nothing left to watch or the source was closed.
+ */
+func (wt *WT) internalProcessNotify() (err error) {
+
+	wt.startBatching()
+	timeout := time.Second * 5
+	for err == nil {
+		ev, err1 := wt.nextEvent(timeout)
+		if err1 == ErrClosed {
+			break
+		}
+		if err1 != nil {
+			err = err1
+			break
 		}
-		stop = wt.processEvent(ev)
+		wt.mu.Lock()
+		err = wt.processEvent(ev)
+		wt.reportWatchLimit()
+		now := time.Now()
+		wt.reportQuietChanges(now)
+		timeout = wt.quietTimeout(now, time.Second*5)
+		if !wt.buffered() {
+			wt.flushBatch()
+		}
+		if err == nil && wt.finished() {
+			err = ErrNoWatches
+		}
+		wt.mu.Unlock()
 	}
 
-	wt.reader.Close()
-	if stop <= 1 {
-		return 0
+	wt.closeSources()
+	wt.mu.Lock()
+	wt.flushBatch()
+	wt.mu.Unlock()
+	if err == ErrNoWatches {
+		err = nil
 	}
 	return
 }
@@ -680,31 +1244,27 @@ func (wt *WT) internalProcessNotify() (stop int) {
  Initialise processing and perform processing loop.
  Shutdown processing upon error or normal return.
  Callback function called whenever notify event asks for special activity.
- Catch all system panics generated while waiting for events.
+ Catch all system panics generated while waiting for events and pass them to the Error callback.
+ ProcessNotifyEvents blocks until there is nothing left to watch;
+ use New and Watcher.Run for a watch which can be stopped.
 */
 func ProcessNotifyEvents(inv []string, exv []string, mask uint32, ncb *NotifyCallbacks) (res int) {
 
 	defer func() {
-		err := recover()
-		switch err := err.(type) {
-		case int:
-			res = err
-		case nil:
-			res = 0
-		default:
-			fmt.Println(err, "returning", 99)
+		if err := recover(); err != nil {
+			if ncb != nil && ncb.Error != nil {
+				ncb.Error(fmt.Errorf("notify: panic: %v", err))
+			}
 			res = 99
 		}
 	}()
 
-	wt := fillWatchTable(inv, exv, mask, ncb)
-
-	if wt == nil || len(wt.data) == 0 {
-		return 1
-	} else {
-		if wt.ncb.Init != nil {
-			wt.ncb.Init()
-		}
+	w, err := New(Options{Includes: inv, Excludes: exv, Mask: mask, Callbacks: ncb})
+	if err == nil {
+		err = w.Run(context.Background())
+	}
+	if err == context.Canceled {
+		err = nil
 	}
-	return wt.internalProcessNotify()
+	return resultCode(err)
 }
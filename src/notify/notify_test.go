@@ -0,0 +1,2201 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fixture is a watchtable on a temporary directory, fed by a ScriptedSource.
+type fixture struct {
+	t      *testing.T
+	dir    string
+	source *ScriptedSource
+	wt     *WT
+	events []string
+	errs   []error
+}
+
+// newFixture creates files and directories (with trailing "/") below a
+// temporary directory, calls setup and scans the directory.
+func newFixture(t *testing.T, files []string, setup func(f *fixture), configure func(wt *WT)) *fixture {
+	f := &fixture{t: t, dir: t.TempDir(), source: NewScriptedSource()}
+	for _, name := range files {
+		if strings.HasSuffix(name, "/") {
+			f.mkdir(name)
+		} else {
+			f.write(name, "x")
+		}
+	}
+	if setup != nil {
+		setup(f)
+	}
+	f.scan(configure)
+	return f
+}
+
+// scan creates a new watchtable and scans the directory.
+func (f *fixture) scan(configure func(wt *WT)) {
+	f.wt = createWatchTable(f.source)
+	f.wt.ncb = &NotifyCallbacks{
+		Event: func(ev *Event) {
+			s := fmt.Sprintf("%s %s", ev.EventType, f.rel(ev.Path))
+			if ev.OldPath != "" {
+				s += " " + f.rel(ev.OldPath)
+			}
+			if ev.EventType == LINK || ev.EventType == DELETE {
+				for _, link := range ev.OtherLinks {
+					s += " " + f.rel(link)
+				}
+			}
+			f.events = append(f.events, strings.TrimSpace(s))
+		},
+		Error: func(err error) {
+			f.errs = append(f.errs, err)
+		},
+	}
+	if configure != nil {
+		configure(f.wt)
+	}
+	if err := fillWatchTable(f.wt, []string{f.dir}, nil); err != nil {
+		f.t.Fatal("fillWatchTable", err)
+	}
+}
+
+func (f *fixture) path(name string) string {
+	return filepath.Join(f.dir, name)
+}
+
+func (f *fixture) rel(path string) string {
+	if path == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(f.dir, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+func (f *fixture) write(name, data string) {
+	if err := os.WriteFile(f.path(name), []byte(data), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fixture) mkdir(name string) {
+	if err := os.MkdirAll(f.path(name), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fixture) must(err error) {
+	if err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// wd returns the watch descriptor of directory name.
+func (f *fixture) wd(name string) uint32 {
+	return f.source.Wd(f.path(name))
+}
+
+// ev scripts an event for name, which is reported by its parent directory.
+func (f *fixture) ev(mask uint32, name string, cookie uint32) {
+	f.source.Push(&EventIntern{Wd: f.wd(filepath.Dir(name)), Mask: mask, Cookie: cookie, Name: filepath.Base(name)})
+}
+
+// self scripts an event of directory name about itself.
+func (f *fixture) self(mask uint32, name string) {
+	f.source.Push(&EventIntern{Wd: f.wd(name), Mask: mask})
+}
+
+// process feeds all scripted events into the watchtable, followed by a timeout.
+func (f *fixture) process() (err error) {
+	for err == nil {
+		ev, _ := f.source.Next(0)
+		if ev == nil {
+			break
+		}
+		err = f.wt.processEvent(ev)
+	}
+	if err == nil {
+		err = f.wt.processEvent(nil)
+	}
+	return
+}
+
+// checkTree compares the watchtable with the file system.
+func (f *fixture) checkTree() {
+	wt := f.wt
+	if len(wt.moved) != 0 || wt.pendingCookie != 0 {
+		f.t.Error("pending moves", len(wt.moved), wt.pendingCookie)
+	}
+	var check func(wde *WatchDirent)
+	check = func(wde *WatchDirent) {
+		path := wde.Path()
+		var stat syscall.Stat_t
+		if err := syscall.Lstat(path, &stat); err != nil {
+			f.t.Error("tracked but missing", f.rel(path))
+			return
+		}
+		if (StatKey{stat.Dev, stat.Ino}) != wde.statid.key() {
+			f.t.Error("tracked with wrong inode", f.rel(path))
+		}
+		if wt.inodes[wde.statid.key()] != wde.statid {
+			f.t.Error("statid not registered", f.rel(path))
+		}
+		if wde.elements == nil {
+			return
+		}
+		if wde.wd == 0 || wt.data[wde.wd] != wde {
+			f.t.Error("directory not watched", f.rel(path))
+		}
+		var names []string
+		all, _ := readDirNames(path)
+		for _, name := range all {
+			info, err := os.Lstat(filepath.Join(path, name))
+			if err == nil && !wt.excluded(wde, name, info.IsDir()) {
+				names = append(names, name)
+			}
+		}
+		if len(names) != wde.elements.len() {
+			f.t.Error("elements of", f.rel(path), names, wde.elements.len())
+		}
+		for _, child := range wde.elements.all() {
+			check(child)
+		}
+	}
+	for _, root := range wt.root.elements.all() {
+		check(root)
+	}
+	dirs := 0
+	wt.root.Walk(func(wde *WatchDirent, depth int) {
+		if wde.elements != nil {
+			dirs++
+		}
+	}, 0)
+	if dirs != wt.dirs {
+		f.t.Error("directories counted", wt.dirs, "in tree", dirs)
+	}
+}
+
+func TestProcessEvents(t *testing.T) {
+	const (
+		ISDIR = syscall.IN_ISDIR
+	)
+	tests := []struct {
+		name      string
+		files     []string
+		setup     func(f *fixture)
+		configure func(wt *WT)
+		action    func(f *fixture)
+		want      []string
+		unordered bool  // compare sorted events
+		wantErr   error // returned by processEvent
+		wantErrs  error // reported as non-fatal error
+		skipCheck bool  // the tree is inconsistent on purpose
+	}{
+		{
+			name: "create file",
+			action: func(f *fixture) {
+				f.write("a", "")
+				f.ev(syscall.IN_CREATE, "a", 0)
+			},
+			want: []string{"CREATE a"},
+		},
+		{
+			name: "create, modify and close file",
+			action: func(f *fixture) {
+				f.write("a", "data")
+				f.ev(syscall.IN_CREATE, "a", 0)
+				f.ev(syscall.IN_MODIFY, "a", 0)
+				f.ev(syscall.IN_CLOSE_WRITE, "a", 0)
+			},
+			want: []string{"CREATE a", "CHANGE a"},
+		},
+		{
+			name:  "close without modify",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.ev(syscall.IN_CLOSE_WRITE, "a", 0)
+			},
+		},
+		{
+			name: "create directory with contents",
+			action: func(f *fixture) {
+				f.mkdir("d/e")
+				f.write("d/e/x", "")
+				f.ev(syscall.IN_CREATE|ISDIR, "d", 0)
+			},
+			want: []string{"CREATE d", "CREATE d/e", "CREATE d/e/x"},
+		},
+		{
+			name:  "create hard link",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Link(f.path("a"), f.path("b")))
+				f.ev(syscall.IN_CREATE, "b", 0)
+			},
+			want: []string{"LINK b a"},
+		},
+		{
+			name:  "move file",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.path("a"), f.path("b")))
+				f.ev(syscall.IN_MOVED_FROM, "a", 1)
+				f.ev(syscall.IN_MOVED_TO, "b", 1)
+			},
+			want: []string{"MOVE b a"},
+		},
+		{
+			name:  "move file followed by other event",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.path("a"), f.path("b")))
+				f.write("x", "")
+				f.ev(syscall.IN_MOVED_FROM, "a", 2)
+				f.ev(syscall.IN_MOVED_TO, "b", 2)
+				f.ev(syscall.IN_CREATE, "x", 0)
+			},
+			want: []string{"MOVE b a", "CREATE x"},
+		},
+		{
+			name:  "move directory and create in it",
+			files: []string{"d/", "d/x"},
+			action: func(f *fixture) {
+				wd := f.wd("d")
+				f.must(os.Rename(f.path("d"), f.path("e")))
+				f.write("e/y", "")
+				f.ev(syscall.IN_MOVED_FROM|ISDIR, "d", 3)
+				f.ev(syscall.IN_MOVED_TO|ISDIR, "e", 3)
+				f.source.Push(&EventIntern{Wd: wd, Mask: syscall.IN_MOVE_SELF})
+				f.source.Push(&EventIntern{Wd: wd, Mask: syscall.IN_CREATE, Name: "y"})
+			},
+			want: []string{"MOVE e d", "CREATE e/y"},
+		},
+		{
+			name:  "move file out of tree",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.path("a"), filepath.Join(f.t.TempDir(), "a")))
+				f.ev(syscall.IN_MOVED_FROM, "a", 4)
+			},
+			want: []string{"DELETE a"},
+		},
+		{
+			name: "move file into tree",
+			action: func(f *fixture) {
+				outside := filepath.Join(f.t.TempDir(), "c")
+				f.must(os.WriteFile(outside, nil, 0644))
+				f.must(os.Rename(outside, f.path("c")))
+				f.ev(syscall.IN_MOVED_TO, "c", 5)
+			},
+			want: []string{"CREATE c"},
+		},
+		{
+			name:  "delete file",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Remove(f.path("a")))
+				f.ev(syscall.IN_DELETE, "a", 0)
+			},
+			want: []string{"DELETE a"},
+		},
+		{
+			name:  "delete file with other link",
+			files: []string{"a"},
+			setup: func(f *fixture) {
+				f.must(os.Link(f.path("a"), f.path("b")))
+			},
+			action: func(f *fixture) {
+				f.must(os.Remove(f.path("a")))
+				f.ev(syscall.IN_DELETE, "a", 0)
+			},
+			want: []string{"DELETE a b"},
+		},
+		{
+			name:  "delete directory",
+			files: []string{"d/", "d/x"},
+			action: func(f *fixture) {
+				f.must(os.RemoveAll(f.path("d")))
+				f.ev(syscall.IN_DELETE, "d/x", 0)
+				f.self(syscall.IN_DELETE_SELF, "d")
+				f.self(syscall.IN_IGNORED, "d")
+				f.ev(syscall.IN_DELETE|ISDIR, "d", 0)
+			},
+			want: []string{"DELETE d/x", "DELETE d"},
+		},
+		{
+			name:  "change attribute",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Chmod(f.path("a"), 0600))
+				f.ev(syscall.IN_ATTRIB, "a", 0)
+			},
+			want: []string{"ATTRIBUTE a"},
+		},
+		{
+			name: "change attribute of root",
+			action: func(f *fixture) {
+				f.must(os.Chmod(f.dir, 0700))
+				f.self(syscall.IN_ATTRIB, ".")
+			},
+			want: []string{"ATTRIBUTE ."},
+		},
+		{
+			name:  "delete root",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.RemoveAll(f.dir))
+				f.ev(syscall.IN_DELETE, "a", 0)
+				f.self(syscall.IN_DELETE_SELF, ".")
+			},
+			want: []string{"DELETE a", "DELETE ."},
+		},
+		{
+			name:  "move root away",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.dir, f.dir+".moved"))
+				f.t.Cleanup(func() { os.RemoveAll(f.dir + ".moved") })
+				f.self(syscall.IN_MOVE_SELF, ".")
+			},
+			want: []string{"DELETE ."},
+		},
+		{
+			name: "event for unknown element",
+			action: func(f *fixture) {
+				f.write("unknown", "")
+				f.ev(syscall.IN_MODIFY, "unknown", 0)
+			},
+			wantErrs:  ErrMissingElement,
+			skipCheck: true,
+		},
+		{
+			name: "event for removed element",
+			action: func(f *fixture) {
+				f.ev(syscall.IN_CREATE, "removed", 0)
+				f.ev(syscall.IN_MODIFY, "removed", 0)
+				f.ev(syscall.IN_DELETE, "removed", 0)
+			},
+		},
+		{
+			name:  "create of listed element",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.ev(syscall.IN_CREATE, "a", 0)
+			},
+		},
+		{
+			name:  "create of replaced element",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.write("b", "")
+				f.must(os.Rename(f.path("b"), f.path("a")))
+				f.ev(syscall.IN_CREATE, "a", 0)
+			},
+			want: []string{"DELETE a", "CREATE a"},
+		},
+		{
+			name:  "move to listed element",
+			files: []string{"a", "d/"},
+			action: func(f *fixture) {
+				// d/a is listed by the scan of d, before the events are read
+				f.must(os.Rename(f.path("a"), f.path("d/a")))
+				addWatches(f.wt.data[f.wd("d")], "a", f.wt)
+				f.ev(syscall.IN_MOVED_FROM, "a", 7)
+				f.ev(syscall.IN_MOVED_TO, "d/a", 7)
+			},
+			want: []string{"MOVE d/a a"},
+		},
+		{
+			name:  "move directory to listed element",
+			files: []string{"d/", "d/sub/", "d/sub/x", "e/"},
+			action: func(f *fixture) {
+				// e/d is listed by the scan of e, before the events are read,
+				// and shares the watches of d and d/sub
+				wd, sub := f.wd("d"), f.wd("d/sub")
+				f.must(os.Rename(f.path("d"), f.path("e/d")))
+				addWatches(f.wt.data[f.wd("e")], "d", f.wt)
+				if f.wd("e/d") != wd || f.wd("e/d/sub") != sub {
+					f.t.Fatal("duplicate not watched like by inotify")
+				}
+				f.write("e/d/sub/y", "")
+				f.ev(syscall.IN_MOVED_FROM|ISDIR, "d", 10)
+				f.ev(syscall.IN_MOVED_TO|ISDIR, "e/d", 10)
+				f.source.Push(&EventIntern{Wd: wd, Mask: syscall.IN_MOVE_SELF})
+				f.source.Push(&EventIntern{Wd: sub, Mask: syscall.IN_CREATE, Name: "y"})
+			},
+			want: []string{"MOVE e/d d", "CREATE e/d/sub/y"},
+		},
+		{
+			name:  "move over existing file",
+			files: []string{"a", "b"},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.path("a"), f.path("b")))
+				f.ev(syscall.IN_MOVED_FROM, "a", 7)
+				f.ev(syscall.IN_MOVED_TO, "b", 7)
+			},
+			want: []string{"DELETE b", "MOVE b a"},
+		},
+		{
+			name: "create excluded file",
+			configure: func(wt *WT) {
+				wt.addExcludePattern("*.o")
+			},
+			action: func(f *fixture) {
+				f.write("a.o", "")
+				f.ev(syscall.IN_CREATE, "a.o", 0)
+				f.ev(syscall.IN_MODIFY, "a.o", 0)
+				f.ev(syscall.IN_CLOSE_WRITE, "a.o", 0)
+			},
+		},
+		{
+			name:  "scan skips excluded entries",
+			files: []string{"a.o", "b", "d/", "d/c.o", "d/e", "build/", "build/x"},
+			configure: func(wt *WT) {
+				wt.addExcludePattern("*.o")
+				wt.addExcludePattern("build/")
+			},
+			action: func(f *fixture) {
+				f.ev(syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE, "a.o", 0)
+				f.ev(syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE, "d/e", 0)
+			},
+			want: []string{"CHANGE d/e"},
+		},
+		{
+			name: "create directory with excluded entries",
+			configure: func(wt *WT) {
+				wt.addExcludePattern("*.o")
+			},
+			action: func(f *fixture) {
+				f.mkdir("d")
+				f.write("d/x.o", "")
+				f.write("d/y", "")
+				f.ev(syscall.IN_CREATE|ISDIR, "d", 0)
+			},
+			want: []string{"CREATE d", "CREATE d/y"},
+		},
+		{
+			name: "move directory with excluded entries into tree",
+			configure: func(wt *WT) {
+				wt.addExcludePattern("*.o")
+			},
+			action: func(f *fixture) {
+				outside := filepath.Join(f.t.TempDir(), "d")
+				f.must(os.Mkdir(outside, 0755))
+				f.must(os.WriteFile(filepath.Join(outside, "x.o"), nil, 0644))
+				f.must(os.WriteFile(filepath.Join(outside, "y"), nil, 0644))
+				f.must(os.Rename(outside, f.path("d")))
+				f.ev(syscall.IN_MOVED_TO|ISDIR, "d", 8)
+			},
+			want: []string{"CREATE d", "CREATE d/y"},
+		},
+		{
+			name:  "move file to excluded name",
+			files: []string{"a"},
+			configure: func(wt *WT) {
+				wt.addExcludePattern("*.o")
+			},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.path("a"), f.path("a.o")))
+				f.ev(syscall.IN_MOVED_FROM, "a", 6)
+				f.ev(syscall.IN_MOVED_TO, "a.o", 6)
+			},
+			want: []string{"DELETE a"},
+		},
+		{
+			name: "merged create, modify and close",
+			action: func(f *fixture) {
+				f.write("a", "data")
+				f.ev(syscall.IN_CREATE|syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE, "a", 0)
+			},
+			want: []string{"CREATE a", "CHANGE a"},
+		},
+		{
+			name: "merged create and delete",
+			action: func(f *fixture) {
+				f.ev(syscall.IN_CREATE|syscall.IN_MODIFY|syscall.IN_DELETE, "a", 0)
+			},
+		},
+		{
+			name:  "merged delete and create",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Remove(f.path("a")))
+				f.write("a", "new")
+				f.ev(syscall.IN_DELETE|syscall.IN_CREATE|syscall.IN_CLOSE_WRITE, "a", 0)
+			},
+			want: []string{"DELETE a", "CREATE a"},
+		},
+		{
+			name:  "merged move and attribute",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.path("a"), f.path("b")))
+				f.ev(syscall.IN_MOVED_FROM, "a", 5)
+				f.ev(syscall.IN_MOVED_TO|syscall.IN_ATTRIB, "b", 5)
+			},
+			want: []string{"MOVE b a", "ATTRIBUTE b"},
+		},
+		{
+			name:    "queue overflow",
+			action:  func(f *fixture) { f.source.Push(&EventIntern{Wd: ^uint32(0), Mask: syscall.IN_Q_OVERFLOW}) },
+			wantErr: ErrQueueOverflow,
+		},
+		{
+			name:  "queue overflow with rescan",
+			files: []string{"a", "b", "d/"},
+			configure: func(wt *WT) {
+				wt.rescan = true
+			},
+			action: func(f *fixture) {
+				f.must(os.Remove(f.path("a")))
+				f.write("b", "longer data")
+				f.write("c", "")
+				f.write("d/x", "")
+				f.source.Push(&EventIntern{Wd: ^uint32(0), Mask: syscall.IN_Q_OVERFLOW})
+			},
+			want:      []string{"RESYNC", "DELETE a", "CHANGE b", "CREATE c", "CREATE d/x"},
+			unordered: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, test.files, test.setup, test.configure)
+			test.action(f)
+			err := f.process()
+			if !errors.Is(err, test.wantErr) {
+				t.Error("processEvent returned", err, "expected", test.wantErr)
+			}
+			if test.wantErrs == nil && len(f.errs) > 0 {
+				t.Error("unexpected errors", f.errs)
+			}
+			if test.wantErrs != nil && (len(f.errs) == 0 || !errors.Is(f.errs[0], test.wantErrs)) {
+				t.Error("expected error", test.wantErrs, "!=", f.errs)
+			}
+			got := f.events
+			if test.unordered {
+				sort.Strings(got)
+				sort.Strings(test.want)
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("events\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+			if test.wantErr == nil && !test.skipCheck {
+				f.checkTree()
+			}
+		})
+	}
+}
+
+func TestResync(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  []string
+		action func(f *fixture)
+		want   []string
+	}{
+		{
+			name:  "no change",
+			files: []string{"a", "d/", "d/b"},
+		},
+		{
+			name:  "move between directories",
+			files: []string{"d/", "d/a", "d/e/", "d/e/f", "g/"},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.path("d/a"), f.path("g/a")))
+				f.must(os.Rename(f.path("d/e"), f.path("g/h")))
+			},
+			want: []string{"MOVE g/a d/a", "MOVE g/h d/e"},
+		},
+		{
+			name:  "replace and link",
+			files: []string{"a", "b", "c"},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.path("b"), f.path("a")))
+				f.must(os.Link(f.path("c"), f.path("l")))
+			},
+			want: []string{"DELETE a", "LINK l c", "ATTRIBUTE c", "MOVE a b"}, // the link changes ctime of c
+		},
+		{
+			name:  "attribute",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Chmod(f.path("a"), 0600))
+			},
+			want: []string{"ATTRIBUTE a"},
+		},
+		{
+			name:  "pending move",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.path("a"), f.path("b")))
+				// the moved-to event was lost
+				f.must(f.wt.processEvent(&EventIntern{Wd: f.wd("."), Mask: syscall.IN_MOVED_FROM, Cookie: 9, Name: "a"}))
+			},
+			want: []string{"CREATE b", "DELETE a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, test.files, nil, nil)
+			if test.action != nil {
+				test.action(f)
+			}
+			f.wt.resync()
+			if len(f.events) == 0 || f.events[0] != "RESYNC" {
+				t.Fatal("events do not start with RESYNC", f.events)
+			}
+			got := f.events[1:]
+			sort.Strings(got)
+			sort.Strings(test.want)
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("events\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+			if len(f.errs) > 0 {
+				t.Error("unexpected errors", f.errs)
+			}
+			f.checkTree()
+		})
+	}
+}
+
+// TestRootAttribute changes the attributes of a root, which stays watched until it is removed.
+func TestRootAttribute(t *testing.T) {
+	f := newFixture(t, nil, nil, nil)
+	wd := f.wd(".")
+	f.must(os.Chmod(f.dir, 0700))
+	f.self(syscall.IN_ATTRIB, ".")
+	f.must(f.process())
+	if fmt.Sprint(f.events) != "[ATTRIBUTE .]" {
+		t.Error("events", f.events)
+	}
+	if root := f.wt.data[wd]; root == nil || root.wd != wd {
+		t.Fatal("root lost its watch")
+	}
+	f.must(f.wt.removeRoot(f.dir))
+	if f.wd(".") != 0 || len(f.wt.data) != 0 {
+		t.Error("watch of removed root", f.wd("."), len(f.wt.data))
+	}
+}
+
+// poll processes one round of the poller.
+func (f *fixture) poll() {
+	for {
+		ev, err := f.wt.poller.Next(0)
+		if err != nil || ev == nil {
+			f.t.Fatal("poller delivered", ev, err)
+		}
+		if err = f.wt.processEvent(ev); err != nil {
+			f.t.Fatal("processEvent", err)
+		}
+		if ev.Mask&inRescanDone != 0 {
+			return
+		}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  []string
+		action func(f *fixture)
+		want   []string
+	}{
+		{
+			name:  "no change",
+			files: []string{"a", "d/", "d/b"},
+		},
+		{
+			name:  "create and change",
+			files: []string{"a", "d/"},
+			action: func(f *fixture) {
+				f.write("a", "longer data")
+				f.write("d/b", "")
+				f.mkdir("e")
+				f.write("e/c", "")
+			},
+			want: []string{"CHANGE a", "CREATE d/b", "CREATE e", "CREATE e/c"},
+		},
+		{
+			name:  "delete",
+			files: []string{"a", "d/", "d/b"},
+			action: func(f *fixture) {
+				f.must(os.Remove(f.path("a")))
+				f.must(os.RemoveAll(f.path("d")))
+			},
+			want: []string{"DELETE a", "DELETE d"},
+		},
+		{
+			name:  "move between directories",
+			files: []string{"d/", "d/a", "d/e/", "d/e/f", "g/"},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.path("d/a"), f.path("g/a")))
+				f.must(os.Rename(f.path("d/e"), f.path("g/h")))
+			},
+			want: []string{"MOVE g/a d/a", "MOVE g/h d/e"},
+		},
+		{
+			name:  "link",
+			files: []string{"a"},
+			action: func(f *fixture) {
+				f.must(os.Link(f.path("a"), f.path("b")))
+			},
+			want: []string{"LINK b a"},
+		},
+		{
+			name:  "replace",
+			files: []string{"a", "b"},
+			action: func(f *fixture) {
+				f.must(os.Rename(f.path("b"), f.path("a")))
+			},
+			want: []string{"DELETE a", "MOVE a b"},
+		},
+		{
+			name:  "root deleted",
+			files: []string{"a", "d/", "d/b"},
+			action: func(f *fixture) {
+				f.must(os.RemoveAll(f.dir))
+			},
+			want: []string{"DELETE a", "DELETE d/b", "DELETE d", "DELETE ."},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, test.files, nil, func(wt *WT) {
+				wt.backend = BackendPoll
+				wt.pollInterval = time.Nanosecond
+			})
+			for wd := range f.wt.data {
+				if wd < pollWdBase {
+					t.Error("inotify watch in polled root", wd)
+				}
+			}
+			if test.action != nil {
+				test.action(f)
+			}
+			f.poll()
+			got := f.events
+			sort.Strings(got)
+			sort.Strings(test.want)
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("events\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+			if len(f.errs) > 0 {
+				t.Error("unexpected errors", f.errs)
+			}
+			f.checkTree()
+			if _, err := os.Stat(f.dir); err != nil {
+				if !f.wt.finished() {
+					t.Error("deleted root still watched")
+				}
+				return
+			}
+			f.events = nil
+			if f.poll(); len(f.events) > 0 {
+				t.Error("events of second round", f.events)
+			}
+		})
+	}
+}
+
+func TestFanotifySource(t *testing.T) {
+	fs, err := NewFanotifySource(IN_ALL)
+	if err != nil {
+		t.Skip("fanotify not available:", err)
+	}
+	defer fs.Close()
+	dir := t.TempDir()
+	wd, err := fs.AddWatch(dir)
+	if err != nil {
+		t.Fatal("AddWatch", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := fs.Next(time.Second)
+	if err != nil || ev == nil {
+		t.Fatal("Next returned", ev, err)
+	}
+	if ev.Wd != wd || ev.Name != "a" || ev.Mask&syscall.IN_CREATE == 0 || ev.Pid != int32(os.Getpid()) {
+		t.Errorf("unexpected event %+v", *ev)
+	}
+	if err := fs.RemoveWatch(wd); err != nil {
+		t.Error("RemoveWatch", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ev, err = fs.Next(100 * time.Millisecond); ev != nil || err != nil {
+		t.Errorf("event of removed watch %+v %v", ev, err)
+	}
+}
+
+// limitedSource fails like inotify after limit watches.
+type limitedSource struct {
+	*ScriptedSource
+	limit int
+}
+
+func (ls *limitedSource) AddWatch(path string) (uint32, error) {
+	if ls.limit == 0 {
+		return 0, watchError(path, syscall.ENOSPC)
+	}
+	ls.limit--
+	return ls.ScriptedSource.AddWatch(path)
+}
+
+func TestWatchLimit(t *testing.T) {
+	for _, poll := range []bool{false, true} {
+		t.Run(fmt.Sprint("poll=", poll), func(t *testing.T) {
+			f := newFixture(t, []string{"a/", "b/", "c/"}, nil, func(wt *WT) {
+				wt.source = &limitedSource{ScriptedSource: wt.source.(*ScriptedSource), limit: 2}
+				wt.pollUnwatched = poll
+				wt.pollInterval = time.Nanosecond
+			})
+			if len(f.errs) != 1 {
+				t.Fatal("expected one warning", f.errs)
+			}
+			var w *WatchLimitWarning
+			if !errors.As(f.errs[0], &w) || !errors.Is(w, ErrWatchLimit) {
+				t.Fatal("expected WatchLimitWarning", f.errs[0])
+			}
+			if w.Needed != 4 || w.Unwatched != 2 || w.Polled != poll || w.Limit == 0 {
+				t.Errorf("unexpected warning %+v", *w)
+			}
+			if (f.wt.poller != nil) != poll {
+				t.Fatal("poller", f.wt.poller)
+			}
+			if poll {
+				polled := 0
+				for wd, wde := range f.wt.data {
+					if wd >= pollWdBase && wde.parent != &f.wt.root {
+						polled++
+					}
+				}
+				for _, name := range []string{"a", "b", "c"} {
+					f.write(name+"/x", "")
+				}
+				f.poll()
+				if polled == 0 || len(f.events) != polled {
+					t.Error("expected CREATE in polled directories", f.events)
+				}
+			}
+		})
+	}
+}
+
+// TestWatchLimitNew receives the warning of the initial scan from Errors, which is called after New.
+func TestWatchLimitNew(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := New(Options{Includes: []string{dir}, Source: &limitedSource{ScriptedSource: NewScriptedSource(), limit: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := w.Errors()
+	r := startWatcher(t, w)
+	select {
+	case err := <-errs:
+		var warning *WatchLimitWarning
+		if !errors.As(err, &warning) || warning.Unwatched != 2 {
+			t.Error("expected WatchLimitWarning", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("WatchLimitWarning not reported")
+	}
+	r.stop()
+}
+
+func TestSnapshot(t *testing.T) {
+	f := newFixture(t, []string{"a", "b", "c", "d/", "d/x", "d/y", "e/", "f"}, nil, nil)
+	file := filepath.Join(t.TempDir(), "snapshot")
+	f.must(f.wt.saveSnapshot(file))
+
+	// changes while not watching
+	f.must(os.Remove(f.path("a")))
+	f.write("b", "longer data")
+	f.must(os.Chmod(f.path("c"), 0600))
+	f.must(os.Rename(f.path("d"), f.path("e/d2")))
+	f.write("e/d2/y", "changed data")
+	f.write("g", "")
+	f.must(os.Link(f.path("f"), f.path("h")))
+	f.must(os.Rename(f.path("f"), f.path("e/f")))
+
+	records, err := loadSnapshot(file)
+	if err != nil || len(records) != 9 {
+		t.Fatal("loadSnapshot", len(records), err)
+	}
+	f.scan(nil)
+	f.wt.diffSnapshot(records)
+	want := []string{"DELETE a", "CHANGE b", "ATTRIBUTE c", "MOVE e/d2 d", "CHANGE e/d2/y",
+		"MOVE e/f f", "CREATE g", "LINK h e/f"}
+	got := f.events
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(f.errs) > 0 {
+		t.Error("unexpected errors", f.errs)
+	}
+
+	// unchanged tree
+	f.must(f.wt.saveSnapshot(file))
+	records, _ = loadSnapshot(file)
+	f.events = nil
+	f.wt.diffSnapshot(records)
+	if len(f.events) > 0 {
+		t.Error("events of unchanged tree", f.events)
+	}
+	if records, err = loadSnapshot(filepath.Join(t.TempDir(), "missing")); records != nil || err != nil {
+		t.Error("missing snapshot", records, err)
+	}
+}
+
+// TestSnapshotCorrupt receives the failure of loading a snapshot from Errors.
+func TestSnapshotCorrupt(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "snapshot")
+	if err := os.WriteFile(file, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := New(Options{Includes: []string{t.TempDir()}, Snapshot: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := w.Errors()
+	r := startWatcher(t, w)
+	select {
+	case err := <-errs:
+		var perr *PathError
+		if !errors.As(err, &perr) || perr.Op != "snapshot" || perr.Path != file {
+			t.Error("expected snapshot error", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("snapshot error not reported")
+	}
+	r.stop()
+}
+
+// treeListing describes the tree of wt, including the hard links of each entry.
+func (f *fixture) treeListing() (list []string) {
+	f.wt.root.Walk(func(wde *WatchDirent, depth int) {
+		links := 0
+		for link := wde.statid.first; link != nil; link = link.next {
+			links++
+		}
+		list = append(list, fmt.Sprintf("%s %o %d", f.rel(wde.Path()), wde.statid.filestat.Mode, links))
+	}, 0)
+	sort.Strings(list)
+	return
+}
+
+func TestParallelScan(t *testing.T) {
+	files := []string{"a/", "a/b/", "a/b/c/", "a/b/c/f", "a/g", "d/", "d/.ignore", "d/x.tmp", "d/e/", "h"}
+	for i := 0; i < 50; i++ {
+		files = append(files, fmt.Sprintf("m/%02d/", i), fmt.Sprintf("m/%02d/f", i))
+	}
+	setup := func(f *fixture) {
+		f.write("d/.ignore", "*.tmp\n")
+		f.must(os.Link(f.path("a/g"), f.path("d/e/g")))
+		f.must(os.Symlink("a", f.path("l")))
+	}
+	configure := func(workers int) func(wt *WT) {
+		return func(wt *WT) {
+			wt.ignoreFile = ".ignore"
+			wt.scanWorkers = workers
+		}
+	}
+	serial := newFixture(t, files, setup, configure(0))
+
+	f := &fixture{t: t, dir: serial.dir, source: NewScriptedSource()}
+	var progress []ScanProgress
+	f.scan(func(wt *WT) {
+		configure(4)(wt)
+		wt.ncb.Progress = func(p *ScanProgress) { progress = append(progress, *p) }
+	})
+	f.checkTree()
+	if len(f.errs) > 0 {
+		t.Error("unexpected errors", f.errs)
+	}
+	want, got := serial.treeListing(), f.treeListing()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("parallel scan\n%s\nserial scan\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(f.wt.data) != len(serial.wt.data) || len(f.wt.inodes) != len(serial.wt.inodes) {
+		t.Error("watches or inodes differ", len(f.wt.data), len(serial.wt.data), len(f.wt.inodes), len(serial.wt.inodes))
+	}
+	last := ScanProgress{Root: f.dir, Dirs: len(f.wt.data), Files: len(got) - 1, Done: true}
+	if len(progress) != 1 || progress[0] != last {
+		t.Errorf("progress %v, want %v", progress, last)
+	}
+}
+
+// benchmarkScan scans a tree of 200 directories with 50 files each.
+func benchmarkScan(b *testing.B, workers int) {
+	dir := b.TempDir()
+	for i := 0; i < 200; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%d/s%d", i%10, i))
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 50; j++ {
+			if err := os.WriteFile(filepath.Join(sub, fmt.Sprint("f", j)), nil, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wt := createWatchTable(NewScriptedSource())
+		wt.ncb = &NotifyCallbacks{}
+		wt.scanWorkers = workers
+		if err := fillWatchTable(wt, []string{dir}, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScanSerial(b *testing.B)   { benchmarkScan(b, 0) }
+func BenchmarkScanParallel(b *testing.B) { benchmarkScan(b, 8) }
+
+func TestDirElements(t *testing.T) {
+	de := &dirElements{}
+	for i := 0; i < 2*smallDir; i++ {
+		de.set(&WatchDirent{name: fmt.Sprint(i)})
+		if de.len() != i+1 || (de.index != nil) != (i >= smallDir) {
+			t.Fatal("set", i, de.len(), de.index != nil)
+		}
+	}
+	replaced := &WatchDirent{name: "3"}
+	de.set(replaced)
+	if de.len() != 2*smallDir || de.get("3") != replaced || de.get("x") != nil {
+		t.Error("replace", de.len())
+	}
+	for i := 2*smallDir - 1; i >= 0; i-- {
+		de.remove(fmt.Sprint(i))
+		if de.len() != i || de.get(fmt.Sprint(i)) != nil || (de.index != nil) != (i > smallDir/2) {
+			t.Fatal("remove", i, de.len(), de.index != nil)
+		}
+		n := 0
+		for name, wde := range de.all() {
+			if wde.name != name || de.get(name) != wde {
+				t.Error("all", name)
+			}
+			n++
+		}
+		if n != i {
+			t.Error("all", n, i)
+		}
+	}
+	var none *dirElements
+	if none.get("x") != nil || none.len() != 0 {
+		t.Error("nil elements")
+	}
+}
+
+// watchRun is a Watcher, which is run in the background of a test.
+type watchRun struct {
+	*Watcher
+	t      *testing.T
+	events <-chan Event
+	done   chan error // result of Run
+}
+
+// runWatcher creates a Watcher with opts, subscribes to its events and runs it.
+func runWatcher(t *testing.T, opts Options) *watchRun {
+	t.Helper()
+	w, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startWatcher(t, w)
+}
+
+// startWatcher subscribes to the events of w and runs it.
+// The Watcher is closed at the end of the test.
+func startWatcher(t *testing.T, w *Watcher) *watchRun {
+	r := &watchRun{Watcher: w, t: t, events: w.Events(), done: make(chan error, 1)}
+	go func() { r.done <- w.Run(context.Background()) }()
+	t.Cleanup(func() { w.Close() })
+	return r
+}
+
+// stop closes the Watcher and checks, that Run returns without error.
+func (r *watchRun) stop() {
+	r.t.Helper()
+	r.Close()
+	r.wait()
+}
+
+// wait checks, that Run returns without error within two seconds.
+func (r *watchRun) wait() {
+	r.t.Helper()
+	select {
+	case err := <-r.done:
+		if err != nil {
+			r.t.Error("Run", err)
+		}
+	case <-time.After(2 * time.Second):
+		r.t.Fatal("Run did not return")
+	}
+}
+
+// expectEvents receives len(want) events and compares them, formatted by format, with want.
+func expectEvents(t *testing.T, events <-chan Event, format func(ev *Event) string, want ...string) {
+	t.Helper()
+	var got []string
+	timeout := time.After(2 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatal("events closed after", got)
+			}
+			got = append(got, format(&ev))
+		case <-timeout:
+			t.Fatal("missing events after", got)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("events %q, want %q", got, want)
+	}
+}
+
+// relEvent formats an event as its type followed by its paths relative to base.
+func relEvent(base string) func(ev *Event) string {
+	return func(ev *Event) string {
+		s := ev.EventType.String()
+		for _, path := range []string{ev.Path, ev.OldPath} {
+			if path != "" {
+				rel, _ := filepath.Rel(base, path)
+				s += " " + rel
+			}
+		}
+		return s
+	}
+}
+
+// TestBatch checks, that the events queued before a read are delivered as one batch.
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	var batches [][]Event
+	var events []Event
+	w, err := New(Options{Includes: []string{dir}, Callbacks: &NotifyCallbacks{
+		Event: func(ev *Event) { events = append(events, *ev) },
+		Batch: func(evs []Event) { batches = append(batches, evs) },
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := w.Batches()
+	for i := 0; i < 20; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprint("f", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := startWatcher(t, w)
+	var streamed [][]Event
+	for evs := range stream {
+		streamed = append(streamed, evs)
+		if n := len(evs); n > 0 && evs[n-1].Path == filepath.Join(dir, "f19") {
+			r.Close()
+		}
+	}
+	r.wait()
+	if len(batches) != 1 || len(events) != 20 || fmt.Sprint(batches[0]) != fmt.Sprint(events) {
+		t.Errorf("%d batches, %d events", len(batches), len(events))
+	}
+	if fmt.Sprint(streamed) != fmt.Sprint(batches) {
+		t.Error("streamed batches", streamed)
+	}
+}
+
+// TestNextBatch reads all queued events at once, and one by one with a minimal buffer.
+func TestNextBatch(t *testing.T) {
+	for _, size := range []int{DefaultReadBuffer, 0} {
+		er, err := NewEventReaderSize(syscall.IN_CREATE, size)
+		if err != nil {
+			t.Skip("inotify not available:", err)
+		}
+		dir := t.TempDir()
+		if _, err = er.AddWatch(dir); err != nil {
+			t.Fatal(err)
+		}
+		name := strings.Repeat("x", NAME_MAX-3)
+		for i := 0; i < 10; i++ {
+			if err := os.Mkdir(filepath.Join(dir, fmt.Sprint(name, i)), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var reads []int
+		for n := 0; n < 10; {
+			evs, err := er.NextBatch()
+			if err != nil {
+				t.Fatal(err)
+			}
+			reads = append(reads, len(evs))
+			n += len(evs)
+		}
+		if size > 0 && len(reads) != 1 || size == 0 && len(reads) != 10 {
+			t.Error("events per read", size, reads)
+		}
+		er.Close()
+	}
+}
+
+// waitGoroutines waits for the goroutines started since n were counted to end.
+func waitGoroutines(t *testing.T, n int) {
+	for i := 0; runtime.NumGoroutine() > n; i++ {
+		if i == 100 {
+			t.Error("goroutines left", runtime.NumGoroutine(), n)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSourceClose closes the sources, while Next is waiting and events are pending.
+func TestSourceClose(t *testing.T) {
+	sources := map[string]func() (EventSource, error){
+		"inotify":  func() (EventSource, error) { return NewEventReader(IN_ALL) },
+		"fanotify": func() (EventSource, error) { return NewFanotifySource(IN_ALL) },
+	}
+	for name, create := range sources {
+		t.Run(name, func(t *testing.T) {
+			goroutines := runtime.NumGoroutine()
+			source, err := create()
+			if err != nil {
+				t.Skip(name, " not available: ", err)
+			}
+			dir := t.TempDir()
+			if _, err := source.AddWatch(dir); err != nil {
+				t.Fatal(err)
+			}
+			result := make(chan error)
+			go func() {
+				for {
+					if _, err := source.Next(time.Minute); err != nil {
+						result <- err
+						return
+					}
+				}
+			}()
+			for i := 0; i < 100; i++ {
+				if err := os.WriteFile(filepath.Join(dir, fmt.Sprint("f", i)), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := source.Close(); err != nil {
+				t.Error("Close", err)
+			}
+			select {
+			case err := <-result:
+				if err != ErrClosed {
+					t.Error("Next returned", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Next not released by Close")
+			}
+			if err := source.Close(); err != nil {
+				t.Error("second Close", err)
+			}
+			if ev, err := source.Next(0); ev != nil || err != ErrClosed {
+				t.Error("Next after Close", ev, err)
+			}
+			if _, err := source.AddWatch(dir); !errors.Is(err, ErrClosed) {
+				t.Error("AddWatch after Close", err)
+			}
+			waitGoroutines(t, goroutines)
+		})
+	}
+}
+
+// TestSourceNoFiles lets the sources fail after their first file descriptor.
+// The descriptor is closed again.
+func TestSourceNoFiles(t *testing.T) {
+	sources := map[string]func() (EventSource, error){
+		"inotify":  func() (EventSource, error) { return NewEventReader(IN_ALL) },
+		"fanotify": func() (EventSource, error) { return NewFanotifySource(IN_ALL) },
+	}
+	for name, create := range sources {
+		t.Run(name, func(t *testing.T) {
+			if source, err := create(); err != nil {
+				t.Skip(name, " not available: ", err)
+			} else {
+				source.Close()
+			}
+			free, err := syscall.Dup(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			syscall.Close(free)
+			var limit syscall.Rlimit
+			if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+				t.Fatal(err)
+			}
+			low := limit
+			low.Cur = uint64(free + 1)
+			if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &low); err != nil {
+				t.Fatal(err)
+			}
+			source, err := create()
+			if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+				t.Fatal(err)
+			}
+			if err == nil {
+				source.Close()
+				t.Fatal("source created without file descriptors")
+			}
+			if !errors.Is(err, syscall.EMFILE) {
+				t.Error("expected EMFILE", err)
+			}
+			if fd, err := syscall.Dup(0); err != nil || fd != free {
+				t.Error("file descriptor left open", free, fd, err)
+			} else {
+				syscall.Close(fd)
+			}
+		})
+	}
+}
+
+// TestWatcherClose stops a Watcher, while events are pending and not consumed,
+// and an idle Watcher, which is waiting for events.
+func TestWatcherClose(t *testing.T) {
+	backends := map[string]Backend{"inotify": BackendInotify, "fanotify": BackendFanotify}
+	for name, backend := range backends {
+		for _, files := range []int{200, 0} {
+			t.Run(fmt.Sprint(name, ",files=", files), func(t *testing.T) {
+				goroutines := runtime.NumGoroutine()
+				dir := t.TempDir()
+				w, err := New(Options{Includes: []string{dir}, Backend: backend})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := w.wt.source.(*FanotifySource); backend == BackendFanotify && !ok {
+					w.Close()
+					t.Skip("fanotify not available")
+				}
+				r := startWatcher(t, w)
+				for i := 0; i < files; i++ {
+					if err := os.WriteFile(filepath.Join(dir, fmt.Sprint("f", i)), nil, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				r.stop()
+				for range r.events {
+				}
+				waitGoroutines(t, goroutines)
+			})
+		}
+	}
+}
+
+// TestCloseFromCallback stops a Watcher from its Event callback.
+func TestCloseFromCallback(t *testing.T) {
+	dir := t.TempDir()
+	var w *Watcher
+	w, err := New(Options{Includes: []string{dir}, Callbacks: &NotifyCallbacks{
+		Event: func(ev *Event) { w.Close() },
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := startWatcher(t, w)
+	if err := os.WriteFile(filepath.Join(dir, "a"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.wait()
+	if err := w.AddRoot(dir); !errors.Is(err, ErrClosed) {
+		t.Error("AddRoot after Close returned", err)
+	}
+}
+
+// TestFanotifyFallback exhausts the fanotify groups, so that New falls back to inotify.
+// The failure of fanotify is received from Errors, which is called after New.
+func TestFanotifyFallback(t *testing.T) {
+	var groups []*FanotifySource
+	defer func() {
+		for _, fs := range groups {
+			fs.Close()
+		}
+	}()
+	for len(groups) < 1024 {
+		fs, err := NewFanotifySource(IN_ALL)
+		if err != nil {
+			break
+		}
+		groups = append(groups, fs)
+	}
+	if len(groups) == 0 || len(groups) == 1024 {
+		t.Skip("fanotify not available or not limited")
+	}
+	w, err := New(Options{Includes: []string{t.TempDir()}, Backend: BackendFanotify})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := w.Errors()
+	if _, ok := w.wt.source.(*EventReader); !ok {
+		t.Fatal("no fallback to inotify")
+	}
+	r := startWatcher(t, w)
+	select {
+	case err := <-errs:
+		if !errors.Is(err, syscall.EMFILE) {
+			t.Error("fallback reported as", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("fallback not reported")
+	}
+	r.stop()
+}
+
+// TestStreamErrors replays the errors queued before Run to a later consumer.
+func TestStreamErrors(t *testing.T) {
+	early, late := errors.New("early"), errors.New("late")
+	for _, subscribe := range []bool{true, false} {
+		s := createEventStream(0)
+		s.pushError(early)
+		if subscribe {
+			s.subscribe(false, false, true)
+		} else {
+			s.subscribe(true, false, false)
+		}
+		s.start()
+		s.pushError(late)
+		s.finish(nil)
+		var got []error
+		for err := range s.errchan {
+			got = append(got, err)
+		}
+		for range s.evchan {
+		}
+		if want := []error{early, late}; subscribe && fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("errors %v, want %v", got, want)
+		}
+		if !subscribe && len(got) > 0 {
+			t.Errorf("errors %v without subscription", got)
+		}
+	}
+}
+
+// TestRunCancelled checks, that the channels are closed, if ctx is cancelled before Run returns.
+func TestRunCancelled(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		w, err := New(Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events := w.Events()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := w.Run(ctx); err != ErrNoWatches {
+			t.Error("Run", err)
+		}
+		select {
+		case _, ok := <-events:
+			if ok {
+				t.Error("event received")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("events not closed")
+		}
+	}
+}
+
+// TestAddRemoveRoot changes the roots of a running Watcher.
+func TestAddRemoveRoot(t *testing.T) {
+	base := t.TempDir()
+	path := func(name string) string { return filepath.Join(base, name) }
+	write := func(name string) {
+		t.Helper()
+		if err := os.WriteFile(path(name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"a/sub", "b", "c"} {
+		if err := os.MkdirAll(path(dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := New(Options{Includes: []string{path("a"), path("missing")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := w.Errors()
+	r := startWatcher(t, w)
+	select {
+	case err := <-errs:
+		if !errors.Is(err, syscall.ENOENT) {
+			t.Error("missing include reported as", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("missing include not reported")
+	}
+
+	for _, name := range []string{"a", "a/sub", "."} {
+		if err := r.AddRoot(path(name)); !errors.Is(err, ErrOverlappingRoot) {
+			t.Errorf("AddRoot %s returned %v", name, err)
+		}
+	}
+	for _, name := range []string{"b", "a/sub", "missing"} {
+		if err := r.RemoveRoot(path(name)); !errors.Is(err, ErrUnknownRoot) {
+			t.Errorf("RemoveRoot %s returned %v", name, err)
+		}
+	}
+	if err := r.AddRoot(path("b")); err != nil {
+		t.Fatal("AddRoot", err)
+	}
+	write("b/x")
+	expectEvents(t, r.events, relEvent(base), "CREATE b/x")
+	write("a/sub/y")
+	expectEvents(t, r.events, relEvent(base), "CREATE a/sub/y")
+
+	if err := r.RemoveRoot(path("a")); err != nil {
+		t.Fatal("RemoveRoot", err)
+	}
+	write("a/z")
+	write("b/z")
+	expectEvents(t, r.events, relEvent(base), "CREATE b/z")
+	if err := r.RemoveRoot(path("b")); err != nil {
+		t.Fatal("RemoveRoot", err)
+	}
+	r.wait()
+	if err := r.AddRoot(path("c")); !errors.Is(err, ErrClosed) {
+		t.Error("AddRoot after Run returned", err)
+	}
+}
+
+// TestFollowRoot renames a root, while it is watched, and creates a file in it.
+func TestFollowRoot(t *testing.T) {
+	tests := []struct {
+		follow bool
+		want   []string
+	}{
+		{follow: true, want: []string{"MOVE b a", "CREATE b/sub/x"}},
+		{follow: false, want: []string{"DELETE a"}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint("follow=", test.follow), func(t *testing.T) {
+			base := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(base, "a", "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			r := runWatcher(t, Options{Includes: []string{filepath.Join(base, "a")}, FollowRoots: test.follow})
+			if err := os.Rename(filepath.Join(base, "a"), filepath.Join(base, "b")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(base, "b", "sub", "x"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			expectEvents(t, r.events, relEvent(base), test.want...)
+			r.stop()
+		})
+	}
+}
+
+func TestPersistentRoot(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "a", "b", "f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	roots := []string{filepath.Join(base, "a", "b"), filepath.Join(base, "c", "d")}
+	r := runWatcher(t, Options{Includes: roots, PersistentRoots: true})
+	expect := func(want ...string) {
+		t.Helper()
+		expectEvents(t, r.events, relEvent(base), want...)
+	}
+
+	if err := os.RemoveAll(filepath.Join(base, "a")); err != nil {
+		t.Fatal(err)
+	}
+	expect("DELETE a/b/f", "DELETE a/b")
+	select {
+	case err := <-r.done:
+		t.Fatal("Run returned after the root was deleted:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := os.MkdirAll(filepath.Join(base, "a", "b", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "a", "b", "sub", "x"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("CREATE a/b", "CREATE a/b/sub", "CREATE a/b/sub/x")
+
+	if err := os.MkdirAll(filepath.Join(base, "c", "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "c", "d", "y"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("CREATE c/d", "CREATE c/d/y")
+
+	if err := r.RemoveRoot(roots[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(base, "c")); err != nil {
+		t.Fatal(err)
+	}
+	expect("DELETE c/d/y", "DELETE c/d")
+	if err := r.RemoveRoot(roots[1]); err != nil {
+		t.Fatal(err)
+	}
+	r.wait()
+}
+
+func TestFileRoot(t *testing.T) {
+	base := t.TempDir()
+	conf := filepath.Join(base, "conf")
+	write := func(name string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(base, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("conf")
+	write("other")
+	r := runWatcher(t, Options{Includes: []string{conf}})
+	expect := func(want ...string) {
+		t.Helper()
+		expectEvents(t, r.events, relEvent(base), want...)
+	}
+
+	write("other")
+	write("conf")
+	expect("CHANGE conf")
+	write("conf.tmp")
+	if err := os.Rename(filepath.Join(base, "conf.tmp"), conf); err != nil {
+		t.Fatal(err)
+	}
+	expect("DELETE conf", "CREATE conf")
+	write("conf")
+	expect("CHANGE conf")
+	if err := os.Remove(conf); err != nil {
+		t.Fatal(err)
+	}
+	expect("DELETE conf")
+	write("conf")
+	expect("CREATE conf")
+
+	if err := r.AddRoot(base); err == nil {
+		t.Error("AddRoot of the directory of a file root succeeded")
+	}
+	if err := r.RemoveRoot(conf); err != nil {
+		t.Fatal(err)
+	}
+	r.wait()
+}
+
+func TestAtomicSave(t *testing.T) {
+	tests := []struct {
+		atomic bool
+		temp   string // name of the temporary file, excluded if it ends in .tmp
+		before []string
+		want   []string
+	}{
+		{atomic: false, temp: "conf~", before: []string{"CREATE conf~", "CHANGE conf~"}, want: []string{"DELETE conf", "MOVE conf conf~"}},
+		{atomic: true, temp: "conf~", before: []string{"CREATE conf~", "CHANGE conf~"}, want: []string{"CHANGE conf old"}},
+		{atomic: false, temp: "conf.tmp", want: []string{"DELETE conf", "CREATE conf"}},
+		{atomic: true, temp: "conf.tmp", want: []string{"CHANGE conf old"}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint("atomic=", test.atomic, ",", test.temp), func(t *testing.T) {
+			base := t.TempDir()
+			conf := filepath.Join(base, "conf")
+			if err := os.WriteFile(conf, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var stat syscall.Stat_t
+			if err := syscall.Stat(conf, &stat); err != nil {
+				t.Fatal(err)
+			}
+			oldkey := StatKey{uint64(stat.Dev), uint64(stat.Ino)}
+			r := runWatcher(t, Options{Includes: []string{base}, Excludes: []string{"*.tmp"}, AtomicSave: test.atomic})
+			format := func(ev *Event) string {
+				s := relEvent(base)(ev)
+				if ev.OldKey == oldkey {
+					s += " old"
+				}
+				return s
+			}
+			temp := filepath.Join(base, test.temp)
+			if err := os.WriteFile(temp, []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			expectEvents(t, r.events, format, test.before...)
+			if err := os.Rename(temp, conf); err != nil {
+				t.Fatal(err)
+			}
+			expectEvents(t, r.events, format, test.want...)
+			r.stop()
+		})
+	}
+}
+
+func TestEventMetadata(t *testing.T) {
+	base := t.TempDir()
+	r := runWatcher(t, Options{Includes: []string{base}})
+	next := func(want EventType, name string) Event {
+		t.Helper()
+		for {
+			select {
+			case ev := <-r.events:
+				if ev.EventType == want && filepath.Base(ev.Path) == name {
+					return ev
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("missing", want, name)
+			}
+		}
+	}
+	file := filepath.Join(base, "file")
+	if err := os.WriteFile(file, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ev := next(CHANGE, "file")
+	if ev.Kind != KindRegular || ev.Size != 3 || ev.Mode&0777 != 0644 || int(ev.Uid) != os.Getuid() {
+		t.Errorf("CHANGE %v size %d mode %o uid %d", ev.Kind, ev.Size, ev.Mode, ev.Uid)
+	}
+	if info, err := os.Stat(file); err != nil || !ev.Mtime.Equal(info.ModTime()) {
+		t.Errorf("CHANGE mtime %v, want %v", ev.Mtime, info.ModTime())
+	}
+	if err := os.Chmod(file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ev = next(ATTRIBUTE, "file")
+	if ev.Changed != AttrMode || ev.Mode&0777 != 0600 {
+		t.Errorf("ATTRIBUTE changed %v mode %o", ev.Changed, ev.Mode)
+	}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	ev = next(ATTRIBUTE, "file")
+	if ev.Changed != AttrMtime || !ev.Mtime.Equal(mtime) {
+		t.Errorf("ATTRIBUTE changed %v mtime %v, want %v", ev.Changed, ev.Mtime, mtime)
+	}
+	if err := os.Mkdir(filepath.Join(base, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if ev = next(CREATE, "dir"); ev.Kind != KindDir {
+		t.Errorf("CREATE dir kind %v", ev.Kind)
+	}
+	if err := os.Symlink("file", filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if ev = next(CREATE, "link"); ev.Kind != KindSymlink || ev.Size != 4 {
+		t.Errorf("CREATE link kind %v size %d", ev.Kind, ev.Size)
+	}
+	r.stop()
+}
+
+func TestEventJSON(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 5, time.UTC)
+	ev := Event{
+		EventType:  ATTRIBUTE,
+		Path:       "/a/b",
+		OtherLinks: []string{"/a/c"},
+		Key:        StatKey{Dev: 0x803, Ino: 42},
+		Kind:       KindRegular,
+		Size:       3,
+		Mode:       syscall.S_IFREG | 0600,
+		Uid:        1000,
+		Mtime:      mtime,
+		Changed:    AttrMode | AttrUid,
+	}
+	data, err := json.Marshal(&ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"ATTRIBUTE","path":"/a/b","otherLinks":["/a/c"],"key":"803.42","kind":"regular",` +
+		`"size":3,"mode":33152,"uid":1000,"mtime":"2024-05-01T12:00:00.000000005Z","changed":"mode,uid"}`
+	if string(data) != want {
+		t.Errorf("json %s, want %s", data, want)
+	}
+	var back Event
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(back) != fmt.Sprint(ev) {
+		t.Errorf("decoded %v, want %v", back, ev)
+	}
+	if err := json.Unmarshal([]byte(`{"type":"TOUCH"}`), &back); err == nil {
+		t.Error("unknown event type decoded")
+	}
+}
+
+func TestEventSeq(t *testing.T) {
+	base := t.TempDir()
+	var seqs []uint64
+	r := runWatcher(t, Options{Includes: []string{base}, Callbacks: &NotifyCallbacks{
+		Event: func(ev *Event) { seqs = append(seqs, ev.Seq) },
+	}})
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := os.WriteFile(filepath.Join(base, fmt.Sprint("f", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var last Event
+	for want := uint64(1); want <= 10; want++ {
+		select {
+		case ev := <-r.events:
+			if ev.Seq != want {
+				t.Fatalf("seq %d, want %d", ev.Seq, want)
+			}
+			if ev.Time.Before(start) || ev.Time.Before(last.Time) || ev.Time.After(time.Now()) {
+				t.Errorf("time %v of event %d after %v, started %v", ev.Time, ev.Seq, last.Time, start)
+			}
+			last = ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("missing event", want)
+		}
+	}
+	r.stop()
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Fatalf("callback seq %v", seqs)
+		}
+	}
+}
+
+// TestEventTimeOrder delivers an event read before the previous event, which has been found by a scan.
+func TestEventTimeOrder(t *testing.T) {
+	wt := createWatchTable(NewScriptedSource())
+	var times []time.Time
+	wt.ncb = &NotifyCallbacks{Event: func(ev *Event) { times = append(times, ev.Time) }}
+	read := time.Now()
+	wt.deliver(&Event{EventType: RESYNC})
+	wt.deliver(&Event{EventType: CREATE, Time: read})
+	if len(times) != 2 || times[1].Before(times[0]) {
+		t.Errorf("times %v", times)
+	}
+}
+
+func TestAccessEvents(t *testing.T) {
+	base := t.TempDir()
+	data := filepath.Join(base, "data")
+	if err := os.WriteFile(data, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(base, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	r := runWatcher(t, Options{Includes: []string{base}, AccessEvents: true})
+
+	f, err := os.Open(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	for i := 0; i < 1000; i++ {
+		if _, err := f.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	if _, err := os.ReadDir(filepath.Join(base, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(data, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, r.events, relEvent(base),
+		"OPEN data", "READ data", "CLOSE data", "OPEN data", "CHANGE data", "CLOSE data")
+	r.stop()
+}
+
+// TestQuietChanges reports the CHANGE of a file written without close at injected times.
+func TestQuietChanges(t *testing.T) {
+	f := newFixture(t, []string{"log"}, nil, func(wt *WT) {
+		wt.quietPeriod = 100 * time.Millisecond
+		wt.maxLatency = 250 * time.Millisecond
+	})
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	process := func(mask uint32, ms int) {
+		t.Helper()
+		f.must(f.wt.processEvent(&EventIntern{Wd: f.wd("."), Mask: mask, Name: "log", Time: at(ms)}))
+	}
+	report := func(ms int, want ...string) {
+		t.Helper()
+		f.events = nil
+		f.wt.reportQuietChanges(at(ms))
+		if fmt.Sprint(f.events) != fmt.Sprint(want) {
+			t.Errorf("at %dms: events %v, want %v", ms, f.events, want)
+		}
+	}
+
+	process(syscall.IN_MODIFY, 0)
+	if timeout := f.wt.quietTimeout(at(0), time.Second); timeout != 100*time.Millisecond {
+		t.Error("timeout after write", timeout)
+	}
+	report(99)
+	report(100, "CHANGE log")
+	if timeout := f.wt.quietTimeout(at(100), time.Second); timeout != time.Second {
+		t.Error("timeout without writes", timeout)
+	}
+
+	// continuous writes are reported after the maximal latency
+	for ms := 200; ms <= 380; ms += 90 {
+		process(syscall.IN_MODIFY, ms)
+	}
+	if timeout := f.wt.quietTimeout(at(380), time.Second); timeout != 70*time.Millisecond {
+		t.Error("timeout of continuous writes", timeout)
+	}
+	report(449)
+	report(450, "CHANGE log")
+
+	// the close after the reported CHANGE reports nothing
+	f.events = nil
+	process(syscall.IN_CLOSE_WRITE, 460)
+	report(1000)
+}
+
+// TestQuietPeriod reports the CHANGE of files, which are written without close, by a running Watcher.
+func TestQuietPeriod(t *testing.T) {
+	base := t.TempDir()
+	r := runWatcher(t, Options{Includes: []string{base}, QuietPeriod: 50 * time.Millisecond, MaxLatency: 100 * time.Millisecond})
+	// await receives events until et of name and returns the events before
+	await := func(et EventType, name string) (skipped []string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case ev := <-r.events:
+				if ev.EventType == et && filepath.Base(ev.Path) == name {
+					return
+				}
+				skipped = append(skipped, ev.EventType.String()+" "+filepath.Base(ev.Path))
+			case <-timeout:
+				t.Fatal("missing", et, name, "after", skipped)
+			}
+		}
+	}
+	create := func(name string) *os.File {
+		t.Helper()
+		f, err := os.Create(filepath.Join(base, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	// continuous writes
+	log := create("log")
+	stop := make(chan struct{})
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				log.WriteString("line\n")
+			}
+		}
+	}()
+	await(CHANGE, "log")
+	close(stop)
+	<-written
+	log.Close()
+
+	// a single write without close
+	quiet := create("quiet")
+	defer quiet.Close()
+	if _, err := quiet.WriteString("line\n"); err != nil {
+		t.Fatal(err)
+	}
+	await(CHANGE, "quiet")
+	quiet.Close()
+	create("marker").Close()
+	if skipped := await(CREATE, "marker"); slices.Contains(skipped, "CHANGE quiet") {
+		t.Error("CHANGE after close without write", skipped)
+	}
+	r.stop()
+}
+
+// nullSource hands out watch descriptors without keeping any state.
+type nullSource struct {
+	lastWd uint32
+}
+
+func (ns *nullSource) AddWatch(path string) (uint32, error) {
+	return atomic.AddUint32(&ns.lastWd, 1), nil
+}
+func (ns *nullSource) RemoveWatch(wd uint32) error                      { return nil }
+func (ns *nullSource) Next(timeout time.Duration) (*EventIntern, error) { return nil, nil }
+func (ns *nullSource) Close() error                                     { return nil }
+
+/*
+ * benchmarkTreeMemory reports the heap bytes per tracked file of the watch tree
+ * for 450 small directories with 8 files and 50 large directories with 60 files.
+ * With unique, the names of the files differ between directories.
+ */
+func benchmarkTreeMemory(b *testing.B, unique bool) {
+	dir := b.TempDir()
+	for i := 0; i < 500; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("p%d", i%20), fmt.Sprint("d", i))
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			b.Fatal(err)
+		}
+		n := 8
+		if i%10 == 0 {
+			n = 60
+		}
+		for j := 0; j < n; j++ {
+			name := fmt.Sprintf("file%02d.go", j)
+			if unique {
+				name = fmt.Sprintf("file%d_%02d.go", i, j)
+			}
+			if err := os.WriteFile(filepath.Join(sub, name), nil, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ResetTimer()
+	var total uint64
+	var files int
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		wt := createWatchTable(&nullSource{})
+		wt.ncb = &NotifyCallbacks{}
+		if err := fillWatchTable(wt, []string{dir}, nil); err != nil {
+			b.Fatal(err)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		total += after.HeapAlloc - before.HeapAlloc
+		files = 0
+		wt.root.Walk(func(wde *WatchDirent, depth int) { files++ }, 0)
+		runtime.KeepAlive(wt)
+	}
+	b.ReportMetric(float64(total)/float64(b.N)/float64(files), "B/file")
+}
+
+func BenchmarkTreeMemory(b *testing.B)       { benchmarkTreeMemory(b, false) }
+func BenchmarkTreeMemoryUnique(b *testing.B) { benchmarkTreeMemory(b, true) }
+
+// TestScanStress creates directories and files while the tree is scanned
+// and while new directories are scanned. Every entry must be found exactly once,
+// with the serial and the parallel scan.
+func TestScanStress(t *testing.T) {
+	for round := 0; round < 2; round++ {
+		er, err := NewEventReader(IN_ALL)
+		if err != nil {
+			t.Skip("inotify not available:", err)
+		}
+		f := &fixture{t: t, dir: t.TempDir()}
+		f.wt = createWatchTable(er)
+		f.wt.scanWorkers = round * 4 // serial, then parallel
+		reported := make(map[string]int)
+		f.wt.ncb = &NotifyCallbacks{
+			Event: func(ev *Event) {
+				if ev.EventType == CREATE || ev.EventType == LINK {
+					reported[f.rel(ev.Path)]++
+				} else {
+					t.Error("unexpected event", ev.EventType, f.rel(ev.Path))
+				}
+			},
+			Error: func(err error) {
+				f.errs = append(f.errs, err)
+			},
+		}
+
+		for i := 0; i < 20; i++ {
+			f.mkdir(fmt.Sprintf("e%02d", i))
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 25; i++ {
+					// new files in directories being scanned
+					for j := 0; j < 20; j++ {
+						os.WriteFile(f.path(fmt.Sprintf("e%02d/f%d.%d", j, w, i)), nil, 0644)
+					}
+					// new directories with contents
+					d := f.path(fmt.Sprintf("d%d.%d", w, i))
+					os.Mkdir(d, 0755)
+					for j := 0; j < 5; j++ {
+						os.WriteFile(filepath.Join(d, fmt.Sprint("f", j)), nil, 0644)
+					}
+					os.Mkdir(filepath.Join(d, "s"), 0755)
+					os.WriteFile(filepath.Join(d, "s", "g"), nil, 0644)
+				}
+			}(w)
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		if err := fillWatchTable(f.wt, []string{f.dir}, nil); err != nil {
+			t.Fatal("fillWatchTable", err)
+		}
+		scanned := make(map[string]bool)
+		f.wt.root.Walk(func(wde *WatchDirent, depth int) {
+			scanned[f.rel(wde.Path())] = true
+		}, 0)
+
+		finished := false
+		for !finished {
+			ev, err := er.Next(100 * time.Millisecond)
+			if err != nil {
+				t.Fatal("Next", err)
+			}
+			if ev == nil {
+				select {
+				case <-done:
+					finished = true
+				default:
+				}
+			}
+			if err = f.wt.processEvent(ev); err != nil {
+				t.Fatal("processEvent", err)
+			}
+		}
+		er.Close()
+
+		for path, n := range reported {
+			if n > 1 || scanned[path] {
+				t.Error("reported twice", path, n, scanned[path])
+			}
+		}
+		if len(f.errs) > 0 {
+			t.Error("unexpected errors", f.errs)
+		}
+		f.checkTree()
+	}
+}
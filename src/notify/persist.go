@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"path/filepath"
+	"slices"
+	"syscall"
+)
+
+/*
+ * Wait for the missing root path to appear by watching its nearest existing ancestor.
+ * The watch is added before the ancestor is checked again, so no creation can be missed.
+ * If the root exists already, it is added and its contents are reported as created.
+ */
+func (wt *WT) armRoot(path string) {
+	for {
+		ancestor := existingAncestor(path)
+		if ancestor == path {
+			var stat syscall.Stat_t
+			if syscall.Lstat(path, &stat) != nil {
+				continue // removed again
+			}
+			wt.releaseAncestor(path)
+			wde, err := wt.insertRoot(path, stat.Mode&syscall.S_IFMT == syscall.S_IFDIR)
+			if err != nil || wde == nil {
+				if err != nil {
+					wt.reportError(err)
+				}
+				return
+			}
+			wde.Walk(func(wde *WatchDirent, depth int) {
+				wt.callback(CREATE, &EventIntern{}, wde, depth == 0)
+			}, 0)
+			return
+		}
+		wd, err := wt.source.AddWatch(ancestor)
+		if err != nil {
+			wt.releaseAncestor(path)
+			wt.reportError(err)
+			return
+		}
+		if wd != wt.pendingRoots[path] {
+			wt.releaseAncestor(path)
+			wt.pendingRoots[path] = wd
+			wt.ancestors[wd] = append(wt.ancestors[wd], path)
+		}
+		if existingAncestor(path) == ancestor {
+			return
+		}
+	}
+}
+
+// processAncestor checks the missing roots, which wait for a change of the watched directory wd.
+func (wt *WT) processAncestor(wd uint32) {
+	for _, path := range slices.Clone(wt.ancestors[wd]) {
+		wt.armRoot(path)
+	}
+}
+
+// releaseAncestor forgets the missing root path and removes the watch of its ancestor, if unused.
+func (wt *WT) releaseAncestor(path string) {
+	wd, ok := wt.pendingRoots[path]
+	if !ok {
+		return
+	}
+	delete(wt.pendingRoots, path)
+	paths := slices.DeleteFunc(wt.ancestors[wd], func(p string) bool { return p == path })
+	if len(paths) > 0 {
+		wt.ancestors[wd] = paths
+		return
+	}
+	delete(wt.ancestors, wd)
+	if wt.data[wd] == nil {
+		wt.source.RemoveWatch(wd)
+	}
+}
+
+// existingAncestor returns path or its nearest ancestor, which is an existing directory.
+func existingAncestor(path string) string {
+	var stat syscall.Stat_t
+	if syscall.Lstat(path, &stat) == nil {
+		return path
+	}
+	for {
+		path = filepath.Dir(path)
+		if syscall.Lstat(path, &stat) == nil && stat.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			return path
+		}
+		if path == "/" {
+			return path
+		}
+	}
+}
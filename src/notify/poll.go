@@ -0,0 +1,231 @@
+package notify
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Backend selects how the roots of a Watcher are observed.
+type Backend int
+
+const (
+	BackendInotify  = Backend(iota) // inotify watches for each directory
+	BackendPoll                     // compare the tree with the file system periodically
+	BackendAuto                     // poll on network and FUSE file systems, inotify otherwise
+	BackendFanotify                 // fanotify file system marks, inotify if not permitted
+)
+
+// DefaultPollInterval is used if Options.PollInterval is zero.
+const DefaultPollInterval = 2 * time.Second
+
+// masks of synthetic events, which are not used by inotify
+const (
+	inRescan     uint32 = 0x00100000 // compare the directory Wd with the file system
+	inRescanDone uint32 = 0x00200000 // end of a round of inRescan events
+)
+
+// pollWdBase is the first watch descriptor of a PollSource, above the range of inotify.
+const pollWdBase uint32 = 1 << 31
+
+/*
+PollSource is an EventSource for file systems, which do not support inotify.
+Each interval, it delivers one rescan event for every watched directory,
+followed by an event, which concludes the round. The Watcher compares the
+directories with the file system and reports the differences.
+*/
+type PollSource struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	wds       map[uint32]bool // watched directories
+	lastWd    uint32          // last assigned watch descriptor
+	due       time.Time       // start of next round
+	pending   []*EventIntern  // rest of the current round
+	done      chan struct{}   // closed by Close
+	closeOnce sync.Once
+}
+
+// NewPollSource creates a PollSource, which polls every interval.
+func NewPollSource(interval time.Duration) *PollSource {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	return &PollSource{
+		interval: interval,
+		wds:      make(map[uint32]bool),
+		lastWd:   pollWdBase - 1,
+		due:      time.Now().Add(interval),
+		done:     make(chan struct{}),
+	}
+}
+
+// AddWatch registers a directory. The path is not used,
+// as the Watcher knows the current path of each watch descriptor.
+func (ps *PollSource) AddWatch(path string) (wd uint32, err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.lastWd++
+	wd = ps.lastWd
+	ps.wds[wd] = true
+	return
+}
+
+// RemoveWatch unregisters the directory wd.
+func (ps *PollSource) RemoveWatch(wd uint32) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.wds, wd)
+	return nil
+}
+
+// Next delivers the next event of the current round, or waits at most
+// timeout for the next round.
+func (ps *PollSource) Next(timeout time.Duration) (ev *EventIntern, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case <-ps.done:
+			return nil, ErrClosed
+		default:
+		}
+		ev = ps.nextPending()
+		wait := ps.wait()
+		if ev != nil || timeout <= 0 {
+			return
+		}
+		if rest := time.Until(deadline); rest < wait {
+			if rest <= 0 {
+				return
+			}
+			wait = rest
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ps.done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// nextPending starts a new round if it is due and returns the next event of the round.
+func (ps *PollSource) nextPending() (ev *EventIntern) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	now := time.Now()
+	if len(ps.pending) == 0 && !now.Before(ps.due) {
+		ps.due = now.Add(ps.interval)
+		if len(ps.wds) > 0 {
+			for wd := range ps.wds {
+				ps.pending = append(ps.pending, &EventIntern{Wd: wd, Mask: inRescan})
+			}
+			ps.pending = append(ps.pending, &EventIntern{Mask: inRescanDone})
+		}
+	}
+	if len(ps.pending) > 0 {
+		ev = ps.pending[0]
+		ps.pending = ps.pending[1:]
+	}
+	return
+}
+
+// wait returns the time until the next event is available.
+func (ps *PollSource) wait() time.Duration {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if len(ps.pending) > 0 {
+		return 0
+	}
+	return time.Until(ps.due)
+}
+
+// buffered is true, if the current round is not finished.
+func (ps *PollSource) buffered() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.pending) > 0
+}
+
+// Close lets Next return ErrClosed.
+func (ps *PollSource) Close() error {
+	ps.closeOnce.Do(func() { close(ps.done) })
+	return nil
+}
+
+// magic numbers of file systems, which do not deliver inotify events for remote changes
+var pollFilesystems = map[int64]bool{
+	0x6969:     true, // NFS_SUPER_MAGIC
+	0x517b:     true, // SMB_SUPER_MAGIC
+	0xff534d42: true, // CIFS_MAGIC_NUMBER
+	0xfe534d42: true, // SMB2_MAGIC_NUMBER
+	0x65735546: true, // FUSE_SUPER_MAGIC
+	0x01021997: true, // V9FS_MAGIC
+	0x00c36400: true, // CEPH_SUPER_MAGIC
+	0x5346414f: true, // AFS_FS_MAGIC
+}
+
+// isPollFilesystem checks the file system type of path with statfs.
+func isPollFilesystem(path string) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return false
+	}
+	return pollFilesystems[int64(fs.Type)&0xffffffff]
+}
+
+/*
+ * Decide if the new root wde is polled and create the poller if required.
+ */
+func (wt *WT) selectBackend(wde *WatchDirent) {
+	polled := wt.pollPaths[wde.name]
+	switch wt.backend {
+	case BackendPoll:
+		polled = true
+	case BackendAuto:
+		polled = polled || isPollFilesystem(wde.name)
+	}
+	if !polled {
+		return
+	}
+	if wt.poller == nil {
+		wt.poller = NewPollSource(wt.pollInterval)
+	}
+	wt.pollRoots[wde] = true
+}
+
+// isPolled is true, if wde belongs to a polled root.
+func (wt *WT) isPolled(wde *WatchDirent) bool {
+	if len(wt.pollRoots) == 0 {
+		return false
+	}
+	for ; wde.parent != nil; wde = wde.parent {
+		if wde.parent == &wt.root {
+			return wt.pollRoots[wde]
+		}
+	}
+	return false
+}
+
+/*
+ * Deliver the next event of the poller, if there is one,
+ * or the next event of the source, while waiting for the next round of the poller.
+ */
+func (wt *WT) nextEvent(timeout time.Duration) (*EventIntern, error) {
+	wt.mu.Lock()
+	poller := wt.poller // may be created by AddRoot
+	wt.mu.Unlock()
+	if poller == nil {
+		return wt.source.Next(timeout)
+	}
+	if ev, err := poller.Next(0); ev != nil || err != nil {
+		return ev, err
+	}
+	if wait := poller.wait(); wait < timeout {
+		timeout = wait
+	}
+	ev, err := wt.source.Next(timeout)
+	if ev == nil && err == nil {
+		return poller.Next(0)
+	}
+	return ev, err
+}
@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"syscall"
+	"time"
+)
+
+// quietChange is the state of a file, which is modified without being closed.
+type quietChange struct {
+	first time.Time // first modification since the last CHANGE
+	last  time.Time // last modification
+}
+
+/*
+ * Note the modification of statid at time t for the quiet period timer.
+ * The CHANGE is reported by reportQuietChanges, unless the file is closed before.
+ */
+func (wt *WT) noteModify(statid *Statid, t time.Time) {
+	if wt.quietPeriod <= 0 {
+		return
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+	if qc := wt.quiet[statid]; qc != nil {
+		qc.last = t
+		return
+	}
+	wt.quiet[statid] = &quietChange{first: t, last: t}
+}
+
+// due returns the time, when the CHANGE of qc has to be reported.
+func (wt *WT) due(qc *quietChange) time.Time {
+	due := qc.last.Add(wt.quietPeriod)
+	if wt.maxLatency > 0 && qc.first.Add(wt.maxLatency).Before(due) {
+		due = qc.first.Add(wt.maxLatency)
+	}
+	return due
+}
+
+/*
+ * Report CHANGE for the files, which were not modified during the quiet period
+ * before now, or which are modified for longer than the maximal latency.
+ * The modification is reset, so a following close without write reports nothing.
+ */
+func (wt *WT) reportQuietChanges(now time.Time) {
+	for statid, qc := range wt.quiet {
+		if wt.due(qc).After(now) {
+			continue
+		}
+		delete(wt.quiet, statid)
+		if wde := statid.first; wde != nil && statid.smask&syscall.IN_MODIFY != 0 {
+			wt.restat(wde)
+			wt.callback(CHANGE, &EventIntern{}, wde, true)
+			statid.resetChanged()
+		}
+	}
+}
+
+// quietTimeout shortens timeout to the time from now until the next quiet CHANGE is due.
+func (wt *WT) quietTimeout(now time.Time, timeout time.Duration) time.Duration {
+	for _, qc := range wt.quiet {
+		if wait := wt.due(qc).Sub(now); wait < timeout {
+			timeout = max(wait, 0)
+		}
+	}
+	return timeout
+}
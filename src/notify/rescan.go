@@ -0,0 +1,251 @@
+package notify
+
+import (
+	"errors"
+	"slices"
+	"syscall"
+)
+
+/*
+ * Recover from a lost event queue.
+ * Report RESYNC, then compare the complete watch tree with the file system
+ * and report all differences as CREATE, DELETE, CHANGE, or ATTRIBUTE events.
+ */
+func (wt *WT) resync() {
+	wt.deliver(&Event{EventType: RESYNC})
+
+	// moves, which are still waiting for their moved-to event, cannot be paired any more
+	wt.pendingCookie = 0
+	for _, wde := range wt.moved {
+		wt.removeHierarchy(wde)
+		wt.callbackDelete(&EventIntern{}, wde)
+	}
+
+	roots := make([]*WatchDirent, 0, wt.root.elements.len())
+	for _, wde := range wt.root.elements.all() {
+		roots = append(roots, wde)
+	}
+	for _, wde := range roots {
+		wt.rescanEntry(&wt.root, wde.name, wde, true)
+	}
+	for path := range wt.pendingRoots {
+		wt.armRoot(path)
+	}
+	wt.finishRescan()
+}
+
+// vanishedCookie marks entries, which were missing in a rescan,
+// while they are waiting in wt.vanished for the end of the rescan.
+const vanishedCookie = ^uint32(0)
+
+/*
+ * Compare all elements of directory wde with the directory on disk.
+ * Subdirectories are compared recursively, if recursive is set.
+ * Missing elements are kept until finishRescan, so they are reported
+ * as MOVE, if they are found in another directory of the same rescan.
+ */
+func (wt *WT) rescanDir(wde *WatchDirent, recursive bool) {
+	if wde.Cookie() != 0 {
+		return
+	}
+	dir := wde.Path()
+	names, err := readDirNames(dir)
+	if err != nil {
+		if wde.parent == &wt.root && errors.Is(err, syscall.ENOENT) {
+			// a polled root has no parent, which would notice its deletion
+			wt.vanishRoot(wde)
+			return
+		}
+		// a directory, which has been removed or moved, is handled by the rescan of its parent
+		if recursive || !errors.Is(err, syscall.ENOENT) {
+			wt.reportError(&PathError{Op: "readdirnames", Path: dir, Err: err})
+		}
+		return
+	}
+	wt.loadIgnoreFile(wde)
+
+	present := make(map[string]bool, len(names))
+	for _, name := range names {
+		present[name] = true
+	}
+	var gone []*WatchDirent
+	for name, wdeold := range wde.elements.all() {
+		if !present[name] {
+			gone = append(gone, wdeold)
+		}
+	}
+	for _, wdeold := range gone {
+		wt.vanish(wdeold)
+	}
+	for _, name := range names {
+		wt.rescanEntry(wde, name, wde.elements.get(name), recursive)
+	}
+}
+
+/*
+ * Report the deletion of the root wde and of its entries, children before their parents,
+ * like inotify does for a deleted tree.
+ */
+func (wt *WT) vanishRoot(wde *WatchDirent) {
+	var entries []*WatchDirent
+	wde.Walk(func(entry *WatchDirent, depth int) {
+		if entry != wde {
+			entries = append(entries, entry)
+		}
+	}, 0)
+	slices.Reverse(entries)
+	for _, entry := range entries {
+		wt.callbackDelete(&EventIntern{}, entry)
+	}
+	wt.processSelf(&EventIntern{Wd: wde.wd, Mask: syscall.IN_DELETE_SELF}, wde)
+}
+
+/*
+ * Compare directory entry name in wde with its tracked state wdeold,
+ * which is nil for a new entry.
+ */
+func (wt *WT) rescanEntry(wde *WatchDirent, name string, wdeold *WatchDirent, recursive bool) {
+	if wdeold == nil {
+		wt.rescanNew(wde, name, recursive)
+		return
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(wdeold.Path(), &stat); err != nil {
+		wt.vanish(wdeold)
+		return
+	}
+	statid := wdeold.statid
+	if (StatKey{stat.Dev, stat.Ino}) != statid.key() {
+		// replaced by a different file
+		wt.vanish(wdeold)
+		wt.rescanNew(wde, name, recursive)
+		return
+	}
+
+	isDir := stat.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	filestat := newFileStat(&stat)
+	data, attr := statChanges(&statid.filestat, &filestat)
+	changed := attrChanges(&statid.filestat, &filestat)
+	statid.filestat = filestat
+	if data && !isDir {
+		wt.callback(CHANGE, &EventIntern{}, wdeold, true)
+		statid.resetChanged()
+	}
+	if attr {
+		ev := newEvent(ATTRIBUTE, &EventIntern{}, wdeold, false)
+		ev.Changed = changed
+		wt.deliver(ev)
+		statid.resetAttribute()
+	}
+	if isDir {
+		if wdeold.wd == 0 {
+			wt.addWatch(wdeold)
+		}
+		if recursive {
+			wt.rescanDir(wdeold, true)
+		}
+	}
+}
+
+/*
+ * Handle the new directory entry name in wde.
+ * If the inode is already known at a path, which does not exist any more,
+ * the entry has been moved. If the old path still exists, it is a new link.
+ * A reused inode number is detected by a different size or modification time.
+ */
+func (wt *WT) rescanNew(wde *WatchDirent, name string, recursive bool) {
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(wde.Path(name), &stat); err != nil {
+		return
+	}
+	key := StatKey{stat.Dev, stat.Ino}
+	filestat := newFileStat(&stat)
+	isDir := stat.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	excluded := wt.excluded(wde, name, isDir)
+	if wdeold := wt.vanished[key]; wdeold != nil {
+		if sameFile(&wdeold.statid.filestat, &filestat) {
+			if !excluded {
+				delete(wt.vanished, key)
+				wt.moveTo(&EventIntern{}, wdeold, wde, name)
+				wdeold.statid.filestat.Ctim = filestat.Ctim // changed by rename
+				wt.rescanEntry(wde, name, wdeold, recursive)
+			}
+			return
+		}
+		// inode number reused by a new file
+		delete(wt.vanished, key)
+		wt.removeHierarchy(wdeold)
+		wt.callbackDelete(&EventIntern{}, wdeold)
+	}
+	if statid := wt.inodes[key]; statid != nil && !excluded {
+		same := sameFile(&statid.filestat, &filestat)
+		for wdelink := statid.first; wdelink != nil; {
+			next := wdelink.next
+			var linkstat syscall.Stat_t
+			err := syscall.Lstat(wdelink.Path(), &linkstat)
+			if err != nil || (StatKey{linkstat.Dev, linkstat.Ino}) != key {
+				// the old path is gone before its directory has been rescanned
+				if same {
+					wt.unlink(wdelink)
+					wdelink.Dequeue()
+					wt.moveTo(&EventIntern{}, wdelink, wde, name)
+					wdelink.statid.filestat.Ctim = filestat.Ctim // changed by rename
+					wt.rescanEntry(wde, name, wdelink, recursive)
+					return
+				}
+				wt.removeHierarchy(wdelink)
+				wt.callbackDelete(&EventIntern{}, wdelink)
+			}
+			wdelink = next
+		}
+	}
+	mask := syscall.IN_CREATE
+	if isDir {
+		mask |= syscall.IN_ISDIR
+	}
+	wt.processCreate(&EventIntern{Mask: uint32(mask), Name: name}, wde)
+}
+
+/*
+ * Detach wde, which is missing on disk, from its parent.
+ * It is deleted by finishRescan unless it is found again.
+ */
+func (wt *WT) vanish(wde *WatchDirent) {
+	key := wde.statid.key()
+	if wdeold := wt.vanished[key]; wdeold != nil {
+		// another link of the same inode vanished before
+		wt.removeHierarchy(wdeold)
+		wt.callbackDelete(&EventIntern{}, wdeold)
+	}
+	wt.unlink(wde)
+	wde.Dequeue()
+	wde.cookie = vanishedCookie
+	wt.vanished[key] = wde
+}
+
+/*
+ * Report all entries, which vanished during the rescan and were not found again, as deleted.
+ */
+func (wt *WT) finishRescan() {
+	for key, wde := range wt.vanished {
+		delete(wt.vanished, key)
+		wt.removeHierarchy(wde)
+		wt.callbackDelete(&EventIntern{}, wde)
+	}
+}
+
+// sameFile is true, if stat may describe the unmodified file old.
+func sameFile(old, stat *fileStat) bool {
+	return old.Mode&syscall.S_IFMT == stat.Mode&syscall.S_IFMT &&
+		old.Size == stat.Size && old.Mtim == stat.Mtim
+}
+
+// statChanges compares two stat results of the same inode.
+// A change of the contents also changes ctime, so attr is
+// reported for a ctime change only if data is unchanged.
+func statChanges(old, new *fileStat) (data, attr bool) {
+	data = old.Size != new.Size || old.Mtim != new.Mtim
+	attr = old.Mode != new.Mode || old.Uid != new.Uid || old.Gid != new.Gid ||
+		!data && old.Ctim != new.Ctim
+	return
+}
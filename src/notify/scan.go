@@ -0,0 +1,173 @@
+package notify
+
+import (
+	"syscall"
+)
+
+// ScanProgress describes the state of the scan of a root.
+type ScanProgress struct {
+	Root  string // path of the root
+	Dirs  int    // directories listed so far
+	Files int    // entries added to the tree so far, including directories
+	Done  bool   // the scan of Root is complete
+}
+
+// progressStep is the number of listed directories between progress reports.
+const progressStep = 1000
+
+// scanJob is a directory to be watched and listed by a scan worker.
+type scanJob struct {
+	wde    *WatchDirent
+	path   string
+	source EventSource
+}
+
+// scanEntry is the stat data of a directory entry found by a scan worker.
+type scanEntry struct {
+	name   string
+	statid *Statid
+	err    error
+}
+
+// scanResult is the outcome of a scanJob.
+type scanResult struct {
+	scanJob
+	wd      uint32
+	werr    error // error of adding the watch
+	err     error // error of listing the directory
+	entries []scanEntry
+}
+
+/*
+ * Scan the new root wde and report the progress.
+ * With more than one worker, the directories are watched, listed and their entries
+ * examined concurrently. The results are merged into the tree by the calling goroutine only.
+ */
+func (wt *WT) scanRoot(wde *WatchDirent) {
+	wt.scanning = &ScanProgress{Root: wde.name}
+	if wt.scanWorkers > 1 {
+		wt.scanParallel(wde, wt.scanWorkers)
+	} else {
+		wt.scanDirectory(wde, addWatches)
+	}
+	wt.scanning.Done = true
+	wt.reportProgress()
+	wt.scanning = nil
+}
+
+/*
+ * Scan the tree below wde with a pool of workers.
+ * The pending directories are handed out depth first to keep their number small.
+ */
+func (wt *WT) scanParallel(wde *WatchDirent, workers int) {
+	jobs := make(chan scanJob)
+	results := make(chan *scanResult)
+	for i := 0; i < workers; i++ {
+		go scanWorker(jobs, results)
+	}
+	defer close(jobs)
+
+	pending := []scanJob{wt.newScanJob(wde)}
+	for running := 0; len(pending) > 0 || running > 0; {
+		var send chan<- scanJob // nil if nothing is pending
+		var next scanJob
+		if len(pending) > 0 {
+			send = jobs
+			next = pending[len(pending)-1]
+		}
+		select {
+		case send <- next:
+			pending = pending[:len(pending)-1]
+			running++
+		case res := <-results:
+			running--
+			for _, dir := range wt.mergeScan(res) {
+				pending = append(pending, wt.newScanJob(dir))
+			}
+		}
+	}
+}
+
+// newScanJob prepares the scan of directory wde for a worker.
+func (wt *WT) newScanJob(wde *WatchDirent) scanJob {
+	return scanJob{wde: wde, path: wde.Path(), source: wt.watchSource(wde)}
+}
+
+/*
+ * Process jobs until the channel is closed.
+ * The watch is added before the directory is listed, so no entry can be missed.
+ * The directory is listed even if the watch fails, because the Watcher may poll it instead.
+ */
+func scanWorker(jobs <-chan scanJob, results chan<- *scanResult) {
+	for job := range jobs {
+		res := &scanResult{scanJob: job}
+		res.wd, res.werr = job.source.AddWatch(job.path)
+		var names []string
+		names, res.err = readDirNames(job.path)
+		for _, name := range names {
+			if name == "." || name == ".." {
+				continue
+			}
+			var stat syscall.Stat_t
+			err := syscall.Lstat(job.path+"/"+name, &stat)
+			if err == syscall.ENOENT {
+				continue // removed again before it could be examined
+			}
+			res.entries = append(res.entries, scanEntry{name: name, statid: &Statid{filestat: newFileStat(&stat)}, err: err})
+		}
+		results <- res
+	}
+}
+
+/*
+ * Insert the entries found by a worker into the tree like walkDirectory with addWatches.
+ * Return the new subdirectories to be scanned.
+ */
+func (wt *WT) mergeScan(res *scanResult) (dirs []*WatchDirent) {
+	wde := res.wde
+	if wt.watchAdded(wde, res.path, res.wd, res.werr) != nil {
+		return
+	}
+	if res.err != nil {
+		wt.reportError(&PathError{Op: "readdirnames", Path: res.path, Err: res.err})
+		return
+	}
+	wt.scanned(true)
+	wt.loadIgnoreFile(wde)
+	for _, entry := range res.entries {
+		if entry.err != nil {
+			wt.reportError(&PathError{Op: "lstat", Path: wde.Path(entry.name), Err: entry.err})
+			continue
+		}
+		wdenew := wt.newEntry(wde, entry.name, entry.statid)
+		if wdenew == nil {
+			continue
+		}
+		wt.scanned(false)
+		if wdenew.statid.filestat.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			dirs = append(dirs, wdenew)
+		}
+	}
+	return
+}
+
+// scanned counts a listed directory or a new entry of the running scan of a root.
+func (wt *WT) scanned(listed bool) {
+	p := wt.scanning
+	if p == nil {
+		return
+	}
+	if !listed {
+		p.Files++
+	} else if p.Dirs++; p.Dirs%progressStep == 0 {
+		wt.reportProgress()
+	}
+}
+
+// reportProgress calls the Progress callback with the state of the running scan.
+func (wt *WT) reportProgress() {
+	if wt.ncb != nil && wt.ncb.Progress != nil {
+		p := *wt.scanning
+		wt.ncb.Progress(&p)
+	}
+}
@@ -0,0 +1,140 @@
+package notify
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+ScriptedSource is an EventSource, which replays a script of events instead
+of watching the file system. It is meant for deterministic tests.
+Watch descriptors are assigned in the order of the AddWatch calls and,
+like by inotify, the paths of the same inode share a watch descriptor;
+Wd finds the watch descriptor of a path for writing the script.
+*/
+type ScriptedSource struct {
+	mu     sync.Mutex
+	wds    map[string]uint32  // watch descriptor by path
+	inodes map[StatKey]uint32 // watch descriptor by inode
+	lastWd uint32             // last assigned watch descriptor
+	events []*EventIntern     // script of events not yet delivered
+	closed bool
+	signal chan struct{} // wakes up a waiting Next
+}
+
+// NewScriptedSource creates an empty ScriptedSource
+func NewScriptedSource() *ScriptedSource {
+	return &ScriptedSource{
+		wds:    make(map[string]uint32),
+		inodes: make(map[StatKey]uint32),
+		signal: make(chan struct{}, 1),
+	}
+}
+
+// AddWatch assigns a new watch descriptor to path or returns the existing one of its inode or path.
+func (ss *ScriptedSource) AddWatch(path string) (wd uint32, err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return 0, ErrClosed
+	}
+	var stat syscall.Stat_t
+	found := syscall.Stat(path, &stat) == nil
+	key := StatKey{stat.Dev, stat.Ino}
+	wd, ok := ss.inodes[key]
+	if !found || !ok {
+		if wd, ok = ss.wds[path]; !ok {
+			ss.lastWd++
+			wd = ss.lastWd
+		}
+	}
+	ss.wds[path] = wd
+	if found {
+		ss.inodes[key] = wd
+	}
+	return
+}
+
+// RemoveWatch forgets the paths and the inode of watch descriptor wd.
+func (ss *ScriptedSource) RemoveWatch(wd uint32) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for path, wd1 := range ss.wds {
+		if wd1 == wd {
+			delete(ss.wds, path)
+		}
+	}
+	for key, wd1 := range ss.inodes {
+		if wd1 == wd {
+			delete(ss.inodes, key)
+		}
+	}
+	return nil
+}
+
+// Wd returns the watch descriptor of path or 0 if path is not watched.
+func (ss *ScriptedSource) Wd(path string) uint32 {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.wds[path]
+}
+
+// Push appends events to the script.
+func (ss *ScriptedSource) Push(events ...*EventIntern) {
+	ss.mu.Lock()
+	ss.events = append(ss.events, events...)
+	ss.mu.Unlock()
+	select {
+	case ss.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of events not yet delivered.
+func (ss *ScriptedSource) Len() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.events)
+}
+
+// Next delivers the next event of the script. If the script is exhausted,
+// it waits at most timeout for Push.
+func (ss *ScriptedSource) Next(timeout time.Duration) (ev *EventIntern, err error) {
+	var timer *time.Timer
+	for {
+		ss.mu.Lock()
+		switch {
+		case ss.closed:
+			err = ErrClosed
+		case len(ss.events) > 0:
+			ev = ss.events[0]
+			ss.events = ss.events[1:]
+		}
+		ss.mu.Unlock()
+		if ev != nil || err != nil || timeout <= 0 {
+			return
+		}
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-ss.signal:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// Close lets Next return ErrClosed.
+func (ss *ScriptedSource) Close() error {
+	ss.mu.Lock()
+	ss.closed = true
+	ss.mu.Unlock()
+	select {
+	case ss.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package notify
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// snapshotVersion is incremented with incompatible changes of snapshotRecord
+const snapshotVersion = 1
+
+// snapshotRecord is the persisted state of one directory entry.
+type snapshotRecord struct {
+	Path  string
+	Key   StatKey
+	Mode  uint32
+	Size  int64
+	Mtime syscall.Timespec
+	Ctime syscall.Timespec
+}
+
+// snapshot is the content of a snapshot file
+type snapshot struct {
+	Version int
+	Records []snapshotRecord
+}
+
+/*
+ * Write the state of all watched trees to file.
+ * The file is replaced atomically, so an interrupted save keeps the old snapshot.
+ */
+func (wt *WT) saveSnapshot(file string) (err error) {
+	snap := snapshot{Version: snapshotVersion}
+	wt.root.Walk(func(wde *WatchDirent, depth int) {
+		stat := &wde.statid.filestat
+		snap.Records = append(snap.Records, snapshotRecord{
+			Path:  wde.Path(),
+			Key:   wde.statid.key(),
+			Mode:  stat.Mode,
+			Size:  stat.Size,
+			Mtime: syscall.NsecToTimespec(stat.Mtim),
+			Ctime: syscall.NsecToTimespec(stat.Ctim),
+		})
+	}, 0)
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return &PathError{Op: "snapshot", Path: file, Err: err}
+	}
+	err = gob.NewEncoder(tmp).Encode(&snap)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return &PathError{Op: "snapshot", Path: file, Err: err}
+	}
+	return nil
+}
+
+/*
+ * Read a snapshot file. A missing file is not an error.
+ */
+func loadSnapshot(file string) ([]snapshotRecord, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &PathError{Op: "snapshot", Path: file, Err: err}
+	}
+	defer f.Close()
+	var snap snapshot
+	if err = gob.NewDecoder(f).Decode(&snap); err == nil && snap.Version != snapshotVersion {
+		err = fmt.Errorf("unsupported version %d", snap.Version)
+	}
+	if err != nil {
+		return nil, &PathError{Op: "snapshot", Path: file, Err: err}
+	}
+	return snap.Records, nil
+}
+
+/*
+ * Report the differences between the records of a snapshot and the watch tree
+ * as if they had been observed. Records of paths outside the roots are ignored.
+ * An entry is recognized as moved, if its StatKey is found at a new path.
+ * For a moved directory, only the directory is reported, like by inotify.
+ */
+func (wt *WT) diffSnapshot(records []snapshotRecord) {
+	current := make(map[string]*WatchDirent)
+	byKey := make(map[StatKey][]*WatchDirent)
+	wt.root.Walk(func(wde *WatchDirent, depth int) {
+		current[wde.Path()] = wde
+		byKey[wde.statid.key()] = append(byKey[wde.statid.key()], wde)
+	}, 0)
+	for _, links := range byKey {
+		sort.Slice(links, func(i, j int) bool { return links[i].Path() < links[j].Path() })
+	}
+	inRoots := func(path string) bool {
+		for root := range wt.rootPaths() {
+			if path == root || strings.HasPrefix(path, root+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	recs := make([]*snapshotRecord, 0, len(records))
+	unchanged := make(map[string]bool) // paths with the same key in snapshot and tree
+	for i := range records {
+		rec := &records[i]
+		if inRoots(rec.Path) {
+			recs = append(recs, rec)
+			if wde := current[rec.Path]; wde != nil && wde.statid.key() == rec.Key {
+				unchanged[rec.Path] = true
+			}
+		}
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Path < recs[j].Path })
+
+	seen := make(map[*WatchDirent]bool)
+	var deleted []string // deleted directories, whose contents are not reported
+	isDeleted := func(path string) bool {
+		for _, dir := range deleted {
+			if strings.HasPrefix(path, dir+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	for i, rec := range recs {
+		if isDeleted(rec.Path) {
+			continue
+		}
+		isDir := rec.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		if wde := current[rec.Path]; wde != nil && wde.statid.key() == rec.Key {
+			seen[wde] = true
+			wt.diffRecord(rec, wde, false)
+			continue
+		}
+		if wde := wt.movedEntry(rec, byKey[rec.Key], seen, unchanged); wde != nil {
+			seen[wde] = true
+			newpath := wde.Path()
+			wt.callback(MOVE, &EventIntern{}, wde, false, rec.Path)
+			wt.diffRecord(rec, wde, true)
+			if isDir {
+				for _, child := range recs[i+1:] {
+					if strings.HasPrefix(child.Path, rec.Path+"/") {
+						child.Path = newpath + child.Path[len(rec.Path):]
+					}
+				}
+			}
+			continue
+		}
+		if wt.snapshotExcluded(rec.Path, current, isDir) {
+			continue
+		}
+		if isDir {
+			deleted = append(deleted, rec.Path)
+		}
+		ev := &Event{EventType: DELETE, IsDir: isDir, DataModified: true, Path: rec.Path, Key: rec.Key}
+		ev.setStat(&fileStat{Mode: rec.Mode, Size: rec.Size, Mtim: rec.Mtime.Nano(), Ctim: rec.Ctime.Nano()})
+		wt.deliver(ev)
+	}
+
+	var created []*WatchDirent
+	for path, wde := range current {
+		if !seen[wde] && !unchanged[path] {
+			created = append(created, wde)
+		}
+	}
+	sort.Slice(created, func(i, j int) bool { return created[i].Path() < created[j].Path() })
+	for _, wde := range created {
+		if wde.parent == &wt.root {
+			continue // a new root is not reported
+		}
+		var other *WatchDirent
+		for _, link := range byKey[wde.statid.key()] {
+			if link != wde && (seen[link] || unchanged[link.Path()]) {
+				other = link
+				break
+			}
+		}
+		if other != nil && wde.elements == nil {
+			wt.callback(LINK, &EventIntern{}, wde, false)
+		} else {
+			wt.callback(CREATE, &EventIntern{}, wde, true)
+		}
+		seen[wde] = true
+	}
+}
+
+/*
+ * Find the new location of the entry of rec, which is not at its old path.
+ * A file must have the same size and modification time, a directory the same key only.
+ */
+func (wt *WT) movedEntry(rec *snapshotRecord, links []*WatchDirent, seen map[*WatchDirent]bool, unchanged map[string]bool) *WatchDirent {
+	for _, wde := range links {
+		if seen[wde] || unchanged[wde.Path()] {
+			continue
+		}
+		stat := &wde.statid.filestat
+		if stat.Mode&syscall.S_IFMT != rec.Mode&syscall.S_IFMT {
+			continue
+		}
+		if wde.elements == nil && (stat.Size != rec.Size || stat.Mtim != rec.Mtime.Nano()) {
+			continue
+		}
+		return wde
+	}
+	return nil
+}
+
+/*
+ * Report CHANGE or ATTRIBUTE, if the state of wde differs from rec.
+ * After a move, the change of ctime is caused by the rename.
+ */
+func (wt *WT) diffRecord(rec *snapshotRecord, wde *WatchDirent, moved bool) {
+	stat := &wde.statid.filestat
+	isDir := stat.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	data := stat.Size != rec.Size || stat.Mtim != rec.Mtime.Nano()
+	attr := stat.Mode != rec.Mode || !data && !moved && stat.Ctim != rec.Ctime.Nano()
+	if data && !isDir {
+		wt.callback(CHANGE, &EventIntern{}, wde, true)
+	}
+	if attr {
+		wt.callback(ATTRIBUTE, &EventIntern{}, wde, false)
+	}
+}
+
+// snapshotExcluded is true, if the missing path of a record is excluded now.
+func (wt *WT) snapshotExcluded(path string, current map[string]*WatchDirent, isDir bool) bool {
+	parent := current[filepath.Dir(path)]
+	return parent != nil && wt.excluded(parent, filepath.Base(path), isDir)
+}
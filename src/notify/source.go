@@ -0,0 +1,25 @@
+package notify
+
+import (
+	"time"
+)
+
+/*
+EventSource delivers the raw events, which are processed by a Watcher.
+Watch descriptors returned by AddWatch appear in the Wd field of the events.
+Next waits at most timeout for the next event and returns nil without error
+if no event arrived in time. After Close, Next returns ErrClosed.
+Close may be called concurrently with Next and more than once.
+*/
+type EventSource interface {
+	AddWatch(path string) (wd uint32, err error)
+	RemoveWatch(wd uint32) error
+	Next(timeout time.Duration) (*EventIntern, error)
+	Close() error
+}
+
+// bufferedSource is implemented by sources, which deliver several events from one read.
+type bufferedSource interface {
+	// buffered is true, if the next event is available without reading.
+	buffered() bool
+}
@@ -0,0 +1,201 @@
+package notify
+
+import (
+	"sync"
+)
+
+// DefaultEventBuffer is the channel capacity of Watcher.Events if Options.EventBuffer is zero.
+const DefaultEventBuffer = 64
+
+/*
+eventStream decouples event processing from the consumers of
+Watcher.Events, Watcher.Batches and Watcher.Errors.
+Events and errors are appended to unbounded queues by the processing loop,
+which never blocks on a slow consumer. A pump goroutine moves them from the
+queues into the channels. Only the kinds of values a consumer asked for are queued,
+except errors, which are queued before Run starts, so that the errors reported
+by New reach a consumer subscribing afterwards.
+*/
+type eventStream struct {
+	mu          sync.Mutex
+	events      []Event       // queued events, not yet delivered
+	batches     [][]Event     // queued batches, not yet delivered
+	errs        []error       // queued errors, not yet delivered
+	evchan      chan Event    // channel returned by Watcher.Events
+	batchchan   chan []Event  // channel returned by Watcher.Batches
+	errchan     chan error    // channel returned by Watcher.Errors
+	withEvents  bool          // Watcher.Events has been called
+	withBatches bool          // Watcher.Batches has been called
+	withErrors  bool          // Watcher.Errors has been called
+	running     bool          // Run has started, errors are queued only with withErrors
+	finished    bool          // no more values will be pushed, drain queues
+	aborted     bool          // discard queues and stop delivery
+	signal      chan struct{} // wakes up the pump
+	once        sync.Once
+}
+
+// createEventStream constructor
+func createEventStream(buffer int) *eventStream {
+	if buffer <= 0 {
+		buffer = DefaultEventBuffer
+	}
+	return &eventStream{
+		evchan:    make(chan Event, buffer),
+		batchchan: make(chan []Event, buffer),
+		errchan:   make(chan error, buffer),
+		signal:    make(chan struct{}, 1),
+	}
+}
+
+// subscribe enables queueing of events, batches or errors and starts the pump.
+func (s *eventStream) subscribe(events, batches, errors bool) {
+	s.mu.Lock()
+	s.withEvents = s.withEvents || events
+	s.withBatches = s.withBatches || batches
+	s.withErrors = s.withErrors || errors
+	s.mu.Unlock()
+	s.once.Do(func() { go s.pump() })
+}
+
+// start discards the errors queued before Run, if no consumer of errors is subscribed.
+func (s *eventStream) start() {
+	s.mu.Lock()
+	s.running = true
+	if !s.withErrors {
+		s.errs = nil
+	}
+	s.mu.Unlock()
+}
+
+// wake signals the pump without blocking.
+func (s *eventStream) wake() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pushEvent queues a copy of ev if a consumer is subscribed.
+func (s *eventStream) pushEvent(ev *Event) {
+	s.mu.Lock()
+	ok := s.withEvents && !s.finished && !s.aborted
+	if ok {
+		s.events = append(s.events, *ev)
+	}
+	s.mu.Unlock()
+	if ok {
+		s.wake()
+	}
+}
+
+// batching is true, if a consumer of batches is subscribed.
+func (s *eventStream) batching() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.withBatches
+}
+
+// pushBatch queues evs if a consumer is subscribed. evs must not be changed afterwards.
+func (s *eventStream) pushBatch(evs []Event) {
+	s.mu.Lock()
+	ok := s.withBatches && !s.finished && !s.aborted
+	if ok {
+		s.batches = append(s.batches, evs)
+	}
+	s.mu.Unlock()
+	if ok {
+		s.wake()
+	}
+}
+
+// pushError queues err if a consumer is subscribed or Run has not started yet.
+func (s *eventStream) pushError(err error) {
+	s.mu.Lock()
+	ok := (s.withErrors || !s.running) && !s.finished && !s.aborted
+	if ok {
+		s.errs = append(s.errs, err)
+	}
+	s.mu.Unlock()
+	if ok {
+		s.wake()
+	}
+}
+
+// finish queues the final error, if any, and lets the pump close
+// the channels after the queues have been drained.
+func (s *eventStream) finish(err error) {
+	if err != nil {
+		s.pushError(err)
+	}
+	s.mu.Lock()
+	s.finished = true
+	s.mu.Unlock()
+	s.wake()
+}
+
+// abort discards all queued values and lets the pump close the channels.
+func (s *eventStream) abort() {
+	s.mu.Lock()
+	s.aborted = true
+	s.events = nil
+	s.batches = nil
+	s.errs = nil
+	s.mu.Unlock()
+	s.wake()
+}
+
+// pump delivers queued values until the stream is finished and drained or aborted.
+func (s *eventStream) pump() {
+	for {
+		var evchan chan<- Event
+		var batchchan chan<- []Event
+		var errchan chan<- error
+		var ev Event
+		var batch []Event
+		var err error
+
+		s.mu.Lock()
+		if len(s.events) > 0 {
+			evchan, ev = s.evchan, s.events[0]
+		}
+		if len(s.batches) > 0 {
+			batchchan, batch = s.batchchan, s.batches[0]
+		}
+		if s.withErrors && len(s.errs) > 0 {
+			errchan, err = s.errchan, s.errs[0]
+		}
+		if s.aborted || s.finished && evchan == nil && batchchan == nil && errchan == nil {
+			s.mu.Unlock()
+			close(s.evchan)
+			close(s.batchchan)
+			close(s.errchan)
+			return
+		}
+		s.mu.Unlock()
+
+		select {
+		case evchan <- ev:
+			s.mu.Lock()
+			if len(s.events) > 0 {
+				s.events[0] = Event{}
+				s.events = s.events[1:]
+			}
+			s.mu.Unlock()
+		case batchchan <- batch:
+			s.mu.Lock()
+			if len(s.batches) > 0 {
+				s.batches[0] = nil
+				s.batches = s.batches[1:]
+			}
+			s.mu.Unlock()
+		case errchan <- err:
+			s.mu.Lock()
+			if len(s.errs) > 0 {
+				s.errs[0] = nil
+				s.errs = s.errs[1:]
+			}
+			s.mu.Unlock()
+		case <-s.signal:
+		}
+	}
+}
@@ -2,6 +2,7 @@ package notify
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"syscall"
@@ -15,11 +16,16 @@ type EventIntern struct {
 	Mask   uint32
 	Cookie uint32
 	Name   string
+	Pid    int32     // process causing the event, 0 if unknown
+	Time   time.Time // time the event was read, zero if unknown
 }
 
 // maximal size of file name
 const NAME_MAX = 255
 
+// DefaultReadBuffer is the size of the read buffer of an EventReader created by NewEventReader.
+const DefaultReadBuffer = 64 * 1024
+
 /* inotify event masks -- events that are ignored. */
 const IN_IGN uint32 = syscall.IN_ACCESS |
 	syscall.IN_ATTRIB |
@@ -50,6 +56,11 @@ syscall.IN_ATTRIB |
 	syscall.IN_Q_OVERFLOW |
 	syscall.IN_IGNORED
 
+/* events of opening, reading and closing files, which are reported with Options.AccessEvents */
+const IN_READS uint32 = syscall.IN_OPEN |
+	syscall.IN_ACCESS |
+	syscall.IN_CLOSE_NOWRITE
+
 // StatID is the key of an inode
 type StatKey struct {
 	Dev uint64
@@ -64,9 +75,35 @@ func (key StatKey) String() string {
 Statid represents an inode
 */
 type Statid struct {
-	smask    uint32         // aggregation of status changes ATTRIB, MODIFY, CLOSE_WRITE
-	first    *WatchDirent   // first in list of directory entries with same inode
-	filestat syscall.Stat_t // file status as read from syscall.Lstat
+	smask    uint32       // aggregation of status changes ATTRIB, MODIFY, CLOSE_WRITE
+	first    *WatchDirent // first in list of directory entries with same inode
+	filestat fileStat     // file status as read from syscall.Lstat
+}
+
+// fileStat is the part of syscall.Stat_t, which is kept for each inode.
+type fileStat struct {
+	Dev  uint64
+	Ino  uint64
+	Size int64
+	Mtim int64 // modification time in nanoseconds
+	Ctim int64 // status change time in nanoseconds
+	Mode uint32
+	Uid  uint32
+	Gid  uint32
+}
+
+// newFileStat extracts the fileStat from the result of syscall.Lstat.
+func newFileStat(stat *syscall.Stat_t) fileStat {
+	return fileStat{
+		Dev:  uint64(stat.Dev),
+		Ino:  uint64(stat.Ino),
+		Size: stat.Size,
+		Mtim: stat.Mtim.Nano(),
+		Ctim: stat.Ctim.Nano(),
+		Mode: stat.Mode,
+		Uid:  stat.Uid,
+		Gid:  stat.Gid,
+	}
 }
 
 // address converts a Statid address into an integer
@@ -103,58 +140,81 @@ func (s *Statid) isAttributeComplete() bool {
 }
 
 /*
-	EventReader delivers notify.Events after it has been initialized
+	EventReader delivers notify.Events after it has been initialized.
+	It is the inotify implementation of EventSource.
 */
 type EventReader struct {
 	mask       uint32
-	file       *os.File
+	waiter     *fdWaiter // non-blocking inotify file descriptor
 	readbuffer []byte
 	pos        uint32
 	max        uint32
-	channel    chan *EventIntern
+	readTime   time.Time // time of the last read
+}
+
+// NewEventReader creates an initialised EventReader
+func NewEventReader(mask uint32) (er *EventReader, err error) {
+	return NewEventReaderSize(mask, DefaultReadBuffer)
+}
+
+// NewEventReaderSize creates an initialised EventReader, which reads up to size bytes
+// of events at once. The size is at least that of one maximal event.
+func NewEventReaderSize(mask uint32, size int) (er *EventReader, err error) {
+	er = &EventReader{}
+	if err = er.init(mask, size); err != nil {
+		return nil, err
+	}
+	return
 }
 
 // Init initialise EventReader
 // obtain file descripto from inotifyInit and store mask to be used for addWatch calls
 func (er *EventReader) Init(mask uint32) (err error) {
+	return er.init(mask, DefaultReadBuffer)
+}
+
+func (er *EventReader) init(mask uint32, size int) (err error) {
 	er.mask = (syscall.IN_ALL_EVENTS & mask) | syscall.IN_DONT_FOLLOW | syscall.IN_EXCL_UNLINK
-	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
 	if err != nil {
-		report(err, "inotify_init1", "", 0)
-		return nil
+		return os.NewSyscallError("inotify_init1", err)
 	}
-	er.file = os.NewFile(uintptr(fd), "inotify")
-	if err != nil {
+	if er.waiter, err = newFdWaiter(fd); err != nil {
 		return
 	}
-	const eventsize = uint32(syscall.SizeofInotifyEvent)
-	size := uint32(eventsize + NAME_MAX + 1)
-	//size := uint32(eventsize+16)
+	const eventsize = syscall.SizeofInotifyEvent
+	if size < eventsize+NAME_MAX+1 {
+		size = eventsize + NAME_MAX + 1
+	}
 	er.readbuffer = make([]byte, size)
 	return
 }
 
-// addWatch call InotifyAddWatch for path, using the fd and mask of EventReader
-func (er *EventReader) addWatch(path string) (wd uint32, err error) {
-	fd := int(er.file.Fd())
-	wd1, err := syscall.InotifyAddWatch(fd, path, er.mask)
+// AddWatch call InotifyAddWatch for path, using the fd and mask of EventReader
+func (er *EventReader) AddWatch(path string) (wd uint32, err error) {
+	err = er.waiter.use(func(fd int) error {
+		wd1, err := syscall.InotifyAddWatch(fd, path, er.mask)
+		wd = uint32(wd1)
+		return err
+	})
 	if err != nil {
-		report(err, "inotifyAddWatch", path, 0)
+		return 0, watchError(path, err)
 	}
-	wd = uint32(wd1)
 	return
 }
 
-// call InotifyRmWatch for watch descriptor , using fd from EventReader
-func (er *EventReader) removeWatch(wd uint32) (err error) {
-	fd := int(er.file.Fd())
-	_, err = syscall.InotifyRmWatch(fd, wd)
-	return
+// RemoveWatch call InotifyRmWatch for watch descriptor , using fd from EventReader
+func (er *EventReader) RemoveWatch(wd uint32) (err error) {
+	return er.waiter.use(func(fd int) error {
+		_, err := syscall.InotifyRmWatch(fd, wd)
+		return err
+	})
 }
 
 // Close EventReader by closing underlying file
-func (er *EventReader) Close() {
-	er.file.Close()
+// Waiting calls of NextEventWait return immediately. Close may be called more than once.
+func (er *EventReader) Close() (err error) {
+	return er.waiter.close()
 }
 
 /*
@@ -162,70 +222,82 @@ func (er *EventReader) Close() {
 	The readbuffer size must be able to contain at least one maximal size InotifyEvent
 */
 func (er *EventReader) NextEvent() (ev *EventIntern, err error) {
+	return er.next(-1)
+}
 
-	const eventsize = uint32(syscall.SizeofInotifyEvent)
-	for true {
-		if er.pos+eventsize <= er.max {
-			event := eventPointer(&er.readbuffer[er.pos])
-			if er.pos+eventsize+event.Len <= er.max {
-				ev = &EventIntern{uint32(event.Wd), event.Mask, event.Cookie, eventName(event)}
-				er.pos += eventsize + event.Len
-				break
-			}
-		}
-		copy(er.readbuffer[0:er.max-er.pos], er.readbuffer[er.pos:er.max])
-		er.max -= er.pos
-		er.pos = 0
-		n, err := er.file.Read(er.readbuffer[er.max:])
-		if err != nil {
-			report(err, "Read", er.file.Name(), 0)
-			return ev, err
+// next returns the next event in the read buffer or waits at most timeout for the next read.
+func (er *EventReader) next(timeout time.Duration) (ev *EventIntern, err error) {
+	if ev = er.decode(); ev != nil {
+		return
+	}
+	n, err := er.waiter.read(er.readbuffer, timeout)
+	if err != nil {
+		if err != ErrClosed {
+			err = &PathError{Op: "read", Path: "inotify", Err: err}
 		}
-		er.max += uint32(n)
+		return nil, err
 	}
-	return
+	// inotify reads complete events only
+	er.pos, er.max = 0, uint32(n)
+	er.readTime = time.Now()
+	return er.decode(), nil
 }
 
-func (er *EventReader) NextEventWait(d time.Duration) (event *EventIntern, err error) {
-	if er.channel == nil {
-		er.channel = make(chan *EventIntern, 1)
-		go func() {
-			var event *EventIntern
-			for event, err = er.NextEvent(); err == nil; event, err = er.NextEvent() {
-				er.channel <- event
-			}
-			close(er.channel)
-			er.channel = nil
-		}()
+// decode returns the next event in the read buffer, nil if there is none.
+func (er *EventReader) decode() (ev *EventIntern) {
+	const eventsize = uint32(syscall.SizeofInotifyEvent)
+	if er.pos+eventsize > er.max {
+		return nil
 	}
-	select {
-	case event = <-er.channel:
-		return
-	case <-time.After(d):
-		return
+	buf := er.readbuffer[er.pos:er.max]
+	size := binary.NativeEndian.Uint32(buf[12:])
+	if eventsize+size > uint32(len(buf)) {
+		er.pos = er.max
+		return nil
+	}
+	ev = &EventIntern{
+		Wd:     binary.NativeEndian.Uint32(buf),
+		Mask:   binary.NativeEndian.Uint32(buf[4:]),
+		Cookie: binary.NativeEndian.Uint32(buf[8:]),
+		Name:   byteToString(buf[eventsize:], size),
+		Time:   er.readTime,
+	}
+	er.pos += eventsize + size
+	return
+}
+
+/*
+NextBatch returns all events of the next read from the inotify file descriptor.
+Events left in the read buffer by NextEvent are returned without reading.
+*/
+func (er *EventReader) NextBatch() (evs []*EventIntern, err error) {
+	ev, err := er.NextEvent()
+	for ; ev != nil; ev = er.decode() {
+		evs = append(evs, ev)
 	}
+	return
 }
 
-// eventName extracts the name string from the Name byte slice of the InotifyEvent
-func eventName(event *syscall.InotifyEvent) string {
-	size := event.Len
-	b := make([]byte, event.Len)
-	p0 := uintptr(unsafe.Pointer(&event.Name))
-	for i := uint32(0); i < event.Len; i++ {
-		b[i] = *(*byte)(unsafe.Pointer(uintptr(i) + p0))
-		if b[i] == 0 {
-			size = i
-			break
-		}
+// buffered is true, if the rest of a read is available.
+func (er *EventReader) buffered() bool {
+	return er.pos < er.max
+}
+
+/*
+	NextEventWait waits at most d for the next event.
+	A nil event without error is returned when the time expired.
+	After Close it returns ErrClosed, after a read error the error.
+*/
+func (er *EventReader) NextEventWait(d time.Duration) (event *EventIntern, err error) {
+	if d < 0 {
+		d = 0
 	}
-	//D fmt.Printf("eventName: size=%d Len=%d %s\n", size, event.Len, b)
-	return string(b[:size])
+	return er.next(d)
 }
 
-// eventPointer converts a byte address into a InotifyEvent address
-func eventPointer(ba *byte) (event *syscall.InotifyEvent) {
-	event = (*syscall.InotifyEvent)(unsafe.Pointer(ba))
-	return event
+// Next implements EventSource by NextEventWait
+func (er *EventReader) Next(timeout time.Duration) (*EventIntern, error) {
+	return er.NextEventWait(timeout)
 }
 
 // MaskToString produces a readable string form the Inotify bit mask
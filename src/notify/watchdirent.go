@@ -1,6 +1,8 @@
 package notify
 
 import (
+	"hash/maphash"
+	"iter"
 	"path/filepath"
 )
 
@@ -9,24 +11,163 @@ import (
 
 */
 type WatchDirent struct {
-	wd       uint32                  // watch descriptor if this is a directory
-	name     string                  // name within parent directory (NAME_MAX)
-	parent   *WatchDirent            // pointer to parent directory
-	next     *WatchDirent            // pointer to next file with same inode - nil for directory
-	statid   *Statid                 // pointer to file status information (per inode)
-	cookie   uint32                  // transiently used between move-to and moved-from events
-	elements map[string]*WatchDirent // collection of all directory elements for directory
+	wd       uint32       // watch descriptor if this is a directory
+	name     string       // name within parent directory (NAME_MAX)
+	parent   *WatchDirent // pointer to parent directory
+	next     *WatchDirent // pointer to next file with same inode - nil for directory
+	statid   *Statid      // pointer to file status information (per inode)
+	cookie   uint32       // transiently used between move-to and moved-from events
+	elements *dirElements // collection of all directory elements for directory
 }
 
 // createWatchDirent constructor
 func createWatchDirent(parent *WatchDirent, name string, isdir bool) (wdenew *WatchDirent) {
 	wdenew = &WatchDirent{name: name, parent: parent}
 	if isdir {
-		wdenew.elements = make(map[string]*WatchDirent)
+		wdenew.elements = &dirElements{}
 	}
 	return
 }
 
+// nameTableSize is the number of names kept by a nameTable.
+const nameTableSize = 4096
+
+/*
+nameTable shares the bytes of frequent names like "index.js" or ".git" between
+the entries of a tree. It is a cache of fixed size, which keeps the last name
+per hash value, so names, which occur only once, do not cost any memory.
+*/
+type nameTable struct {
+	seed  maphash.Seed
+	names []string
+}
+
+// intern returns an equal name from the table, if there is one, or enters name.
+func (nt *nameTable) intern(name string) string {
+	if nt.names == nil {
+		nt.seed = maphash.MakeSeed()
+		nt.names = make([]string, nameTableSize)
+	}
+	slot := &nt.names[maphash.String(nt.seed, name)%nameTableSize]
+	if *slot != name {
+		*slot = name
+	}
+	return *slot
+}
+
+// smallDir is the maximal number of elements of a directory, which are kept in a slice.
+const smallDir = 16
+
+/*
+dirElements is the collection of the elements of a directory.
+Small directories are searched linearly in a slice, large ones use a map by name.
+All methods accept a nil receiver for a non-directory without elements.
+*/
+type dirElements struct {
+	list  []*WatchDirent          // elements of a small directory
+	index map[string]*WatchDirent // elements of a large directory, list is nil then
+}
+
+// get returns the element name, nil if there is none.
+func (de *dirElements) get(name string) *WatchDirent {
+	if de == nil {
+		return nil
+	}
+	if de.index != nil {
+		return de.index[name]
+	}
+	for _, wde := range de.list {
+		if wde.name == name {
+			return wde
+		}
+	}
+	return nil
+}
+
+// set adds wde under its name, replacing an element of the same name.
+func (de *dirElements) set(wde *WatchDirent) {
+	if de.index != nil {
+		de.index[wde.name] = wde
+		return
+	}
+	for i, old := range de.list {
+		if old.name == wde.name {
+			de.list[i] = wde
+			return
+		}
+	}
+	if len(de.list) < smallDir {
+		de.list = append(de.list, wde)
+		return
+	}
+	de.index = make(map[string]*WatchDirent, 2*smallDir)
+	for _, old := range de.list {
+		de.index[old.name] = old
+	}
+	de.index[wde.name] = wde
+	de.list = nil
+}
+
+// remove deletes the element name. A map, which became small, is replaced by a slice.
+func (de *dirElements) remove(name string) {
+	if de == nil {
+		return
+	}
+	if de.index != nil {
+		delete(de.index, name)
+		if len(de.index) <= smallDir/2 {
+			de.list = make([]*WatchDirent, 0, smallDir)
+			for _, wde := range de.index {
+				de.list = append(de.list, wde)
+			}
+			de.index = nil
+		}
+		return
+	}
+	for i, wde := range de.list {
+		if wde.name == name {
+			last := len(de.list) - 1
+			de.list[i] = de.list[last]
+			de.list[last] = nil
+			de.list = de.list[:last]
+			return
+		}
+	}
+}
+
+// len returns the number of elements.
+func (de *dirElements) len() int {
+	if de == nil {
+		return 0
+	}
+	if de.index != nil {
+		return len(de.index)
+	}
+	return len(de.list)
+}
+
+// all iterates over the names and elements. They must not be changed meanwhile.
+func (de *dirElements) all() iter.Seq2[string, *WatchDirent] {
+	return func(yield func(string, *WatchDirent) bool) {
+		if de == nil {
+			return
+		}
+		if de.index != nil {
+			for name, wde := range de.index {
+				if !yield(name, wde) {
+					return
+				}
+			}
+			return
+		}
+		for _, wde := range de.list {
+			if !yield(wde.name, wde) {
+				return
+			}
+		}
+	}
+}
+
 func (wde *WatchDirent) Cleanup() {
 	wde.name = ""
 	wde.parent = nil
@@ -90,13 +231,9 @@ func (wde *WatchDirent) Dequeue() {
 }
 
 // child looks up the name in the elements directory of parent.
+// It returns nil if there is no such element.
 func (wde *WatchDirent) child(event *EventIntern) (wdenew *WatchDirent) {
-	name := event.Name
-	wdenew, ok := wde.elements[name]
-	if !ok || wdenew == nil {
-		report(nil, "missing element", wde.Path(name), 64)
-	}
-	return
+	return wde.elements.get(event.Name)
 }
 
 // linkCount gives number of wdes having same inode
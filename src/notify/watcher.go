@@ -0,0 +1,405 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Options configures a Watcher.
+//
+// Excludes contains path names or glob patterns. A pattern contains one of "*?["
+// or starts with "!", which re-includes entries excluded by a previous pattern.
+// Patterns starting with "/" match the complete path name, others match at any
+// depth: "*.o", "**/node_modules", "build/*.tmp". A trailing "/" matches only
+// directories. Ignore files use the same syntax, but patterns containing a "/"
+// are relative to the directory of the ignore file, like in .gitignore.
+// The rules of the deepest ignore file take precedence, followed by the Excludes.
+// Changes of ignore files apply to entries created afterwards.
+//
+// Network and FUSE file systems do not report changes made by other hosts
+// to inotify. Roots on such file systems are observed by polling, if Backend
+// is BackendAuto or the root is listed in PollRoots. Polling compares the
+// directories with the known state each PollInterval. It reports the same
+// event types, but a file, which was modified and renamed between two polls,
+// appears as DELETE and CREATE, and close or open events are not reported.
+//
+// BackendFanotify avoids the per-directory inotify watches, which are limited
+// by max_user_watches, and reports the PID of the process causing each event.
+// It requires CAP_SYS_ADMIN; without it, the Watcher falls back to inotify and
+// reports the failure of fanotify_init as a non-fatal error.
+//
+// If inotify watches are exhausted, a *WatchLimitWarning is reported once
+// per scan or event. With PollUnwatched, these directories are polled instead.
+//
+// With a Snapshot file, the state of the trees is saved when Run returns and
+// by Checkpoint. When Run starts, the differences between the saved state and
+// the scan by New are reported as events, before any live events. A snapshot,
+// which cannot be loaded, is reported as a non-fatal error, when Run starts.
+//
+// With ScanWorkers, the directories of a root are watched, listed and their
+// entries examined by a pool of goroutines, which pays off for large trees.
+// The progress of the scan is reported to the Progress callback.
+//
+// The source reads up to ReadBuffer bytes of events at once. The events caused
+// by one read are passed together to the Batch callback and Watcher.Batches.
+//
+// A renamed root is removed from the Watcher and reported as DELETE. With
+// FollowRoots, it is watched at its new path and reported as MOVE instead,
+// unless the new path is excluded or overlaps another root. The rename of
+// a parent directory of a root is not noticed.
+//
+// A deleted root is reported as DELETE. With PersistentRoots, the nearest
+// existing ancestor of its path is watched instead, and when the root appears
+// again, it is added and reported as CREATE together with its contents. Missing
+// Includes and paths given to AddRoot are waited for in the same way, and the
+// Watcher keeps running while it waits for a root.
+//
+// A root may be a file. Then its directory is watched for events of its name
+// only, so that the root survives editors, which save by renaming a new file
+// over it. The file is reported as DELETE and CREATE, if it is replaced,
+// deleted or created again, as long as its directory exists.
+//
+// Editors and tools save a file by writing a temporary file and renaming it
+// over the file. With AtomicSave, a regular file renamed over another regular
+// file is reported as CHANGE of the replaced path, instead of MOVE and DELETE,
+// with the key of the replaced inode as OldKey. The events of the temporary
+// file before the rename are reported as usual.
+//
+// With AccessEvents, opening a file is reported as OPEN and closing it as
+// CLOSE. The reads between are collected and reported as one READ before the
+// CLOSE. The CHANGE of a modified file precedes its CLOSE. Directories, which
+// are listed, are not reported, and polled roots report none of these events.
+// BackendFanotify may merge the events of consecutive opens of a file, which
+// are not yet read, into one OPEN and CLOSE.
+//
+// A CHANGE is reported when a modified file is closed. Writers like logs and
+// databases keep their files open. With QuietPeriod, a CHANGE is reported also
+// after a file has not been written for the QuietPeriod. With MaxLatency, a
+// CHANGE of a continuously written file is reported at least every MaxLatency.
+// The close of a file, which was not written since, reports no further CHANGE.
+type Options struct {
+	Includes   []string         // paths of directories to be watched recursively, or of files
+	Excludes   []string         // paths or glob patterns to be excluded from watching
+	IgnoreFile string           // name of .gitignore style files in the watched trees, none if empty
+	Mask       uint32           // inotify event mask, IN_ALL if zero
+	Source     EventSource      // source of events, an inotify EventReader if nil
+	Callbacks  *NotifyCallbacks // functions to be called, may be nil
+
+	EventBuffer    int  // capacity of the Events and Errors channels, DefaultEventBuffer if zero
+	OverflowRescan bool // rescan the trees after an inotify queue overflow instead of stopping
+	KeepAlive      bool // keep running without roots, e.g. to wait for AddRoot
+
+	Backend      Backend       // observation of the roots, BackendInotify if zero
+	PollRoots    []string      // roots to be polled with any Backend, also if added by AddRoot
+	PollInterval time.Duration // interval of polling, DefaultPollInterval if zero
+
+	PollUnwatched bool // poll directories, which cannot be watched for lack of inotify watches or instances
+
+	Snapshot string // file keeping the state of the trees between runs, none if empty
+
+	ScanWorkers int // concurrent directory listings when scanning a root, serial if less than 2
+
+	ReadBuffer int // bytes of events read at once from inotify or fanotify, DefaultReadBuffer if zero
+
+	FollowRoots bool // keep watching renamed roots at their new paths
+
+	PersistentRoots bool // wait for missing or deleted roots to appear again
+
+	AtomicSave bool // report a file renamed over another file as CHANGE of that file
+
+	AccessEvents bool // report opening, reading and closing of files
+
+	QuietPeriod time.Duration // report CHANGE of a file written without close after this time without writes
+	MaxLatency  time.Duration // report CHANGE of a continuously written file at least this often, with QuietPeriod
+}
+
+/*
+Watcher is a long-lived watch over a set of directory trees.
+Several Watchers may be used independently in one process.
+A Watcher is created by New, processes events in Run and is stopped
+by Close or by cancelling the context given to Run.
+
+Events are delivered to the Event callback and, after Events has been called,
+to the Events channel. Events and errors are queued inside the Watcher without
+limit, so a slow consumer never stalls reading from inotify, but memory grows
+as long as the consumer lags behind. When Run returns by itself, the queued
+values are still delivered before the channels are closed; Close and
+cancelling the context discard them and close the channels promptly.
+*/
+type Watcher struct {
+	wt      *WT          // watchtable doing all the work
+	stream  *eventStream // delivery to Events and Errors
+	once    sync.Once
+	mu      sync.Mutex
+	started bool        // Run has been called
+	closed  atomic.Bool // shutdown has been called
+}
+
+// errWatcherStarted is returned by Run if the Watcher has been run before
+var errWatcherStarted = errors.New("notify: watcher already started")
+
+/*
+New creates a Watcher and sets up the watches for all included paths.
+Event processing does not start before Run is called.
+*/
+func New(opts Options) (w *Watcher, err error) {
+	mask := opts.Mask
+	if mask == 0 {
+		mask = IN_ALL
+	}
+	if opts.AccessEvents {
+		mask |= IN_READS
+	}
+	ncb := opts.Callbacks
+	if ncb == nil {
+		ncb = &NotifyCallbacks{}
+	}
+	source := opts.Source
+	readBuffer := opts.ReadBuffer
+	if readBuffer == 0 {
+		readBuffer = DefaultReadBuffer
+	}
+	var fallback error
+	var limitWarning *WatchLimitWarning // reported after the scan
+	if source == nil && opts.Backend == BackendFanotify {
+		fs, err := NewFanotifySourceSize(mask, readBuffer)
+		if err == nil {
+			source = fs
+		} else {
+			fallback = err
+		}
+	}
+	if source == nil {
+		er, err := NewEventReaderSize(mask, readBuffer)
+		switch {
+		case err == nil:
+			source = er
+		case errors.Is(err, syscall.EMFILE) && opts.PollUnwatched:
+			// out of inotify instances
+			source = NewPollSource(opts.PollInterval)
+			limitWarning = &WatchLimitWarning{Polled: true, Err: fmt.Errorf("%w: %w", ErrWatchLimit, err)}
+		default:
+			return nil, err
+		}
+	}
+	wt := createWatchTable(source)
+	stream := createEventStream(opts.EventBuffer)
+	wt.ncb = ncb
+	wt.stream = stream
+	wt.ignoreFile = opts.IgnoreFile
+	wt.rescan = opts.OverflowRescan
+	wt.keepAlive = opts.KeepAlive
+	wt.backend = opts.Backend
+	wt.pollInterval = opts.PollInterval
+	wt.pollUnwatched = opts.PollUnwatched
+	wt.scanWorkers = opts.ScanWorkers
+	wt.followRoots = opts.FollowRoots
+	wt.persistRoots = opts.PersistentRoots
+	wt.atomicSave = opts.AtomicSave
+	wt.accessEvents = opts.AccessEvents
+	wt.quietPeriod = opts.QuietPeriod
+	wt.maxLatency = opts.MaxLatency
+	_, wt.selfAttrib = source.(*FanotifySource)
+	if fallback != nil {
+		wt.reportError(fallback)
+	}
+	wt.limitWarning = limitWarning
+	if wt.snapshotFile = opts.Snapshot; wt.snapshotFile != "" {
+		wt.snapshot, wt.snapshotErr = loadSnapshot(wt.snapshotFile)
+	}
+	for _, pa := range opts.PollRoots {
+		if ppath, err := filepath.Abs(filepath.Clean(pa)); err == nil {
+			wt.pollPaths[ppath] = true
+		}
+	}
+	if err = fillWatchTable(wt, opts.Includes, opts.Excludes); err != nil {
+		wt.cleanup()
+		return nil, err
+	}
+	w = &Watcher{wt: wt, stream: stream}
+	return
+}
+
+/*
+Events returns the channel, which receives all events of this Watcher.
+Events are queued only after the first call of Events, so it should be
+called before Run. The channel is closed when the Watcher stops.
+*/
+func (w *Watcher) Events() <-chan Event {
+	w.stream.subscribe(true, false, false)
+	return w.stream.evchan
+}
+
+/*
+Batches returns the channel, which receives the events of this Watcher
+in batches. A batch holds the events caused by one read of the source,
+which saves the overhead of single events during bulk operations.
+Batches are queued only after the first call of Batches, so it should be
+called before Run. The channel is closed when the Watcher stops.
+*/
+func (w *Watcher) Batches() <-chan []Event {
+	w.stream.subscribe(false, true, false)
+	return w.stream.batchchan
+}
+
+/*
+Errors returns the channel, which receives errors of this Watcher.
+If Run stops because of an error, this error is sent last.
+The errors reported by New are kept until Run starts, later errors are
+queued only after the first call of Errors, so it should be called
+before Run. The channel is closed when the Watcher stops.
+*/
+func (w *Watcher) Errors() <-chan error {
+	w.stream.subscribe(false, false, true)
+	return w.stream.errchan
+}
+
+/*
+Run processes events until the watched trees are gone, Close is called
+or ctx is cancelled. Cancelling ctx has the same effect as Close;
+Run returns ctx.Err() in this case. Run may be called only once.
+Run returns ErrNoWatches if there was nothing to watch from the start,
+ErrQueueOverflow or ErrZeroWatch if event processing failed.
+With OverflowRescan a queue overflow is reported as a RESYNC event
+followed by the events for all differences found by a rescan.
+Non-fatal errors are passed to the Error callback and the Errors channel.
+*/
+func (w *Watcher) Run(ctx context.Context) (err error) {
+	w.mu.Lock()
+	started := w.started
+	w.started = true
+	w.mu.Unlock()
+	if started {
+		return errWatcherStarted
+	}
+	w.stream.start()
+	defer w.shutdown()
+	defer func() {
+		if ctx.Err() != nil {
+			w.stream.abort()
+		} else {
+			w.stream.finish(err)
+		}
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.Close()
+		case <-stop:
+		}
+	}()
+
+	wt := w.wt
+	wt.mu.Lock()
+	finished := wt.finished()
+	wt.mu.Unlock()
+	if finished {
+		return ErrNoWatches
+	}
+	if wt.ncb.Init != nil {
+		wt.ncb.Init()
+	}
+	wt.mu.Lock()
+	if wt.snapshotErr != nil {
+		wt.reportError(wt.snapshotErr)
+		wt.snapshotErr = nil
+	}
+	if wt.snapshot != nil {
+		wt.startBatching()
+		wt.diffSnapshot(wt.snapshot)
+		wt.flushBatch()
+		wt.snapshot = nil
+	}
+	wt.mu.Unlock()
+	err = wt.internalProcessNotify()
+	if wt.snapshotFile != "" {
+		wt.mu.Lock()
+		if err1 := wt.saveSnapshot(wt.snapshotFile); err1 != nil {
+			wt.reportError(err1)
+		}
+		wt.mu.Unlock()
+	}
+	if err != nil {
+		return
+	}
+	return ctx.Err()
+}
+
+/*
+Checkpoint saves the state of the trees to the Snapshot file.
+Before Run has started, the loaded snapshot is kept, as its
+differences have not been reported yet.
+Checkpoint must not be called from a callback.
+*/
+func (w *Watcher) Checkpoint() error {
+	wt := w.wt
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	switch {
+	case wt.snapshotFile == "":
+		return ErrNoSnapshot
+	case wt.snapshot != nil:
+		return nil
+	}
+	return wt.saveSnapshot(wt.snapshotFile)
+}
+
+/*
+Close stops a running Watcher and closes its EventSource.
+It is safe to call Close more than once, concurrently with Run and from a callback.
+*/
+func (w *Watcher) Close() error {
+	w.stream.abort()
+	w.shutdown()
+	return nil
+}
+
+// shutdown closes the EventSource, but keeps queued events for delivery.
+// The poller is closed by Run. wt.mu is not taken, as Close may be called from a callback.
+func (w *Watcher) shutdown() {
+	w.once.Do(func() {
+		w.closed.Store(true)
+		w.wt.source.Close()
+	})
+}
+
+/*
+AddRoot adds path as a new root to the Watcher, which may be running.
+The existing contents of path are not reported as events.
+A root must neither contain nor be contained in another root.
+With PersistentRoots, a missing path is added when it appears.
+AddRoot must not be called from a callback.
+*/
+func (w *Watcher) AddRoot(path string) error {
+	w.wt.mu.Lock()
+	defer w.wt.mu.Unlock()
+	if w.closed.Load() {
+		return ErrClosed
+	}
+	_, err := w.wt.addRoot(path)
+	return err
+}
+
+/*
+RemoveRoot stops watching the root path, which has been added by
+Options.Includes or AddRoot. No events are reported for the removed tree.
+The Watcher stops after the last root has been removed, unless KeepAlive is set.
+RemoveRoot must not be called from a callback.
+*/
+func (w *Watcher) RemoveRoot(path string) error {
+	w.wt.mu.Lock()
+	defer w.wt.mu.Unlock()
+	if w.closed.Load() {
+		return ErrClosed
+	}
+	return w.wt.removeRoot(path)
+}
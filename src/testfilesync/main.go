@@ -23,7 +23,7 @@ var excludes FileList
 
 func init() {
 	flag.Var(&includes, "I", "directory to be watched")
-	flag.Var(&excludes, "X", "directory or file to be excluded")
+	flag.Var(&excludes, "X", "directory, file or glob pattern to be excluded")
 }
 
 func main() {
@@ -17,14 +17,19 @@ func doInit() {
 func doReport(path string, event *notify.EventIntern) {
 	fmt.Printf("event: %s %s %d\n", path, maskToString(event.Mask), event.Cookie)
 }
+func doError(err error) {
+	fmt.Println(err)
+}
+
 func doEvent(ev *notify.Event) {
-	fmt.Printf("%v %v %v %s %s %v\n", ev.EventType, ev.IsDir, ev.DataModified, ev.Path, ev.Path2, ev.Key)
+	fmt.Printf("%v %v %v %s %s %v %v %d\n", ev.EventType, ev.IsDir, ev.DataModified, ev.Path, ev.OldPath, ev.OtherLinks, ev.Key, ev.Pid)
 }
 
 var callbacks = notify.NotifyCallbacks{
-	doInit,
-	doReport,
-	doEvent,
+	Init:   doInit,
+	Report: doReport,
+	Event:  doEvent,
+	Error:  doError,
 }
 
 func main() {